@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/mat285/tcptunnel/pkg/client"
+	"github.com/mat285/tcptunnel/pkg/protocol"
 	"github.com/spf13/cobra"
 )
 
@@ -51,6 +53,11 @@ func run() error {
 func main() {
 	err := run()
 	if err != nil {
+		var reject *protocol.RejectError
+		if errors.As(err, &reject) {
+			fmt.Fprintf(os.Stderr, "Server rejected connection: %s (code %d %s)\n", reject.Reason, reject.Code, reject.Code)
+			os.Exit(2)
+		}
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultReconnectMinDelay = 500 * time.Millisecond
+	DefaultReconnectMaxDelay = 30 * time.Second
+)
+
+// Backoff doubles the delay after every attempt up to a maximum. Each delay
+// is jittered between half and all of its value so clients that lost the
+// server together do not reconnect together.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	attempt int
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	if min <= 0 {
+		min = DefaultReconnectMinDelay
+	}
+	if max <= 0 {
+		max = DefaultReconnectMaxDelay
+	}
+	if max < min {
+		max = min
+	}
+	return &Backoff{
+		Min: min,
+		Max: max,
+	}
+}
+
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min
+	for i := 0; i < b.attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.attempt++
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
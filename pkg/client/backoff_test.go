@@ -0,0 +1,45 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		min, max time.Duration
+		attempt  int
+		// the delay is jittered between half and all of want
+		want time.Duration
+	}{
+		{name: "first attempt", min: time.Second, max: time.Minute, attempt: 0, want: time.Second},
+		{name: "doubles", min: time.Second, max: time.Minute, attempt: 3, want: 8 * time.Second},
+		{name: "capped", min: time.Second, max: 10 * time.Second, attempt: 10, want: 10 * time.Second},
+		{name: "defaults", attempt: 0, want: DefaultReconnectMinDelay},
+		{name: "max below min", min: time.Second, max: time.Millisecond, attempt: 2, want: time.Second},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			backoff := NewBackoff(c.min, c.max)
+			for i := 0; i < c.attempt; i++ {
+				backoff.Next()
+			}
+			for i := 0; i < 100; i++ {
+				backoff.attempt = c.attempt
+				delay := backoff.Next()
+				if delay < c.want/2 || delay > c.want {
+					t.Fatalf("delay %s outside %s-%s", delay, c.want/2, c.want)
+				}
+			}
+		})
+	}
+
+	backoff := NewBackoff(time.Second, time.Minute)
+	for i := 0; i < 5; i++ {
+		backoff.Next()
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay > time.Second {
+		t.Fatalf("delay %s after reset", delay)
+	}
+}
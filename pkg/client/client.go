@@ -2,11 +2,17 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/mux"
 	"github.com/mat285/tcptunnel/pkg/protocol"
 	"github.com/mat285/tcptunnel/pkg/tcp"
 )
@@ -14,31 +20,299 @@ import (
 type Client struct {
 	config Config
 
-	ID      uint64
-	cmdConn net.Conn
+	resumeToken  []byte
+	cmdConn      *protocol.CmdConn
+	session      *mux.Session
+	tlsConfig    *tls.Config
+	forwards     []*forward
+	destinations tcp.Rules
+
+	// lock guards what run replaces on each connection for readers outside
+	// it, run's own goroutines are joined before it writes so they read
+	// without it
+	lock               sync.Mutex
+	id                 uint64
+	port               uint16
+	version            uint16
+	serverCapabilities protocol.Capabilities
+	heartbeat          *protocol.Heartbeat
 
 	dataConns map[net.Conn]struct{}
 }
 
+// ErrForwardsUnsupported is returned when the server can only register one
+// of several configured forwards.
+var ErrForwardsUnsupported = errors.New("Server does not support multiple forwards")
+
+// forward is a configured forward and the port the server assigned it.
+type forward struct {
+	Forward
+	port uint16
+}
+
+// remotePort is the port the server assigned, or the configured one before
+// the command connection is established.
+func (f *forward) remotePort() uint16 {
+	if f.port != 0 {
+		return f.port
+	}
+	return f.RemotePort
+}
+
 func NewClient(cfg Config) *Client {
-	return &Client{
+	client := &Client{
 		config:    cfg,
 		dataConns: make(map[net.Conn]struct{}),
 	}
+	for _, f := range cfg.GetForwards() {
+		client.forwards = append(client.forwards, &forward{Forward: f})
+	}
+	return client
+}
+
+// Ports returns the port the server assigned each forward, in the order they
+// are configured.
+func (c *Client) Ports() []uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ports := make([]uint16, 0, len(c.forwards))
+	for _, f := range c.forwards {
+		ports = append(ports, f.port)
+	}
+	return ports
+}
+
+// ID is the ID the server gave the session.
+func (c *Client) ID() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.id
+}
+
+// Port is the port the server assigned the first forward.
+func (c *Client) Port() uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.port
+}
+
+// Version is the protocol version negotiated with the server.
+func (c *Client) Version() uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.version
+}
+
+// Capabilities are the capabilities negotiated with the server.
+func (c *Client) Capabilities() protocol.Capabilities {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.serverCapabilities
 }
 
+// Start connects to the server and serves it until the context is done. Lost
+// connections are reestablished with backoff unless reconnecting is disabled,
+// errors the server rejected us with are returned.
 func (c *Client) Start(ctx context.Context) error {
-	cmdConn, err := c.connect(ctx, protocol.ClientHelloTypeCommand)
+	if len(c.config.Secret) < protocol.MinSecretLength && !c.config.TLS.HasClientCert() {
+		return fmt.Errorf("Secret must be at least %d bytes", protocol.MinSecretLength)
+	}
+	allowed, err := tcp.ParseAddressList(c.config.AllowedDestinations)
 	if err != nil {
 		return err
 	}
-	c.cmdConn = cmdConn
-	return c.listenCommands(ctx)
+	c.destinations = tcp.Rules{Allow: []tcp.AddressList{allowed}}
+	for _, f := range c.forwards {
+		err = tcp.ValidateAddress(f.LocalAddress)
+		if err != nil {
+			return fmt.Errorf("Invalid local address for remote port %d %s", f.RemotePort, err.Error())
+		}
+		if !c.destinations.AllowsFixed(f.LocalAddress) {
+			return fmt.Errorf("Local address %s for remote port %d is not an allowed destination", f.LocalAddress, f.RemotePort)
+		}
+	}
+	for _, f := range c.config.UDPForwards {
+		err = tcp.ValidateAddress(f.LocalAddress)
+		if err == nil && strings.HasPrefix(f.LocalAddress, tcp.UnixPrefix) {
+			err = fmt.Errorf("UDP is not forwarded to Unix sockets")
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid local address for UDP port %d %s", f.RemotePort, err.Error())
+		}
+		if !c.destinations.AllowsFixed(f.LocalAddress) {
+			return fmt.Errorf("Local address %s for UDP port %d is not an allowed destination", f.LocalAddress, f.RemotePort)
+		}
+		if f.RemotePort == 0 {
+			return fmt.Errorf("UDP forwards need a remote port")
+		}
+	}
+	if c.config.LocalPort != 0 {
+		err = tcp.ValidateAddress(c.config.LocalDestination)
+		if err != nil {
+			return fmt.Errorf("Invalid local forwarding destination %s", err.Error())
+		}
+	}
+	if len(c.config.SocksUsername) > 0xff || len(c.config.SocksPassword) > 0xff {
+		return fmt.Errorf("SOCKS username and password must be at most 255 bytes")
+	}
+	if c.config.TLS.Enabled {
+		tlsConfig, err := c.config.TLS.ClientConfig()
+		if err != nil {
+			return err
+		}
+		c.tlsConfig = tlsConfig
+	}
+	log := logger.GetLogger(ctx)
+	ctx = tcp.WithBufferPool(ctx, tcp.NewBufferPool(c.config.TunnelBufferSize))
+	local := c.startLocalForwards(ctx)
+	if !c.config.HasForwards() {
+		return <-local
+	}
+	backoff := NewBackoff(c.config.ReconnectMinDelay, c.config.ReconnectMaxDelay)
+	for {
+		connected, err := c.run(ctx)
+		if ctx.Err() != nil || c.config.DisableReconnect || !retryable(err) {
+			return err
+		}
+		if connected {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		logger.MaybeErrorfContext(ctx, log, "Error connecting to server %s, retrying in %s", err.Error(), delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
 }
 
-func (c *Client) listenCommands(ctx context.Context) error {
+// run serves a single command connection until it fails, connected is false
+// if it could not be established.
+func (c *Client) run(ctx context.Context) (connected bool, err error) {
+	log := logger.GetLogger(ctx)
+	cmdConn, serverHello, err := c.connect(ctx, c.generateClientHello(protocol.ClientHelloTypeCommand, 0, c.forwards[0]))
+	var reject *protocol.RejectError
+	if errors.As(err, &reject) && reject.Code == protocol.RejectCodeResumeFailed {
+		logger.MaybeInfofContext(ctx, log, "Could not resume session %d, registering again", c.id)
+		c.resumeToken = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(serverHello.ResumeToken) > 0 && serverHello.ID == c.id {
+		logger.MaybeInfofContext(ctx, log, "Resumed session %d", c.id)
+	}
+	if len(c.forwards) > 1 && !serverHello.Capabilities.Has(protocol.CapabilityForwards) {
+		cmdConn.Close()
+		return false, ErrForwardsUnsupported
+	}
+	logger.MaybeDebugfContext(ctx, log, "Got ID from server %d using protocol version %d", serverHello.ID, serverHello.Version)
+	c.lock.Lock()
+	c.forwards[0].port = serverHello.Port
+	for i, port := range serverHello.Ports {
+		if i+1 < len(c.forwards) {
+			c.forwards[i+1].port = port
+		}
+	}
+	c.id = serverHello.ID
+	c.port = serverHello.Port
+	c.version = serverHello.Version
+	c.serverCapabilities = serverHello.Capabilities
+	c.lock.Unlock()
+	for _, f := range c.forwards {
+		logger.MaybeInfofContext(ctx, log, "Server is listening for us on port %d forwarding to %s", f.port, f.LocalAddress)
+	}
+	c.resumeToken = serverHello.ResumeToken
+	c.cmdConn = protocol.NewCmdConn(cmdConn)
+	c.session = nil
+	c.setHeartbeat(nil)
+
+	// everything started here is done before the next connection replaces
+	// the fields it uses, tunnels over data connections are independent of
+	// the command connection and may outlive it
+	tunnelCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	goFunc := func(f func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(ctx)
+		}()
+	}
+	goFunc(func(ctx context.Context) {
+		<-ctx.Done()
+		c.cmdConn.Close(ctx)
+	})
+	if c.serverCapabilities.Has(protocol.CapabilityMultiplex) {
+		c.session = mux.NewSession(c.cmdConn, true)
+		goFunc(c.acceptStreams)
+	}
+	if c.serverCapabilities.Has(protocol.CapabilityHeartbeat) {
+		c.setHeartbeat(protocol.NewHeartbeat(c.config.HeartbeatInterval, c.config.HeartbeatMaxMissed))
+		goFunc(c.runHeartbeat)
+	}
+	if c.serverCapabilities.Has(protocol.CapabilityHealthCheck) {
+		for _, f := range c.forwards {
+			f := f
+			goFunc(func(ctx context.Context) {
+				c.runHealthCheck(ctx, f)
+			})
+		}
+	}
+	err = c.listenCommands(ctx, tunnelCtx)
+	if c.session != nil {
+		c.session.Close(err)
+	}
+	return true, err
+}
+
+// retryable reports whether reconnecting could help, rejections other than
+// a failed resume would only be repeated.
+func retryable(err error) bool {
+	var reject *protocol.RejectError
+	if errors.As(err, &reject) {
+		return reject.Code == protocol.RejectCodeResumeFailed
+	}
+	return !errors.Is(err, ErrForwardsUnsupported)
+}
+
+// RTT is the round trip time to the server measured by the most recent
+// heartbeat.
+func (c *Client) RTT() time.Duration {
+	heartbeat := c.getHeartbeat()
+	if heartbeat == nil {
+		return 0
+	}
+	return heartbeat.RTT()
+}
+
+func (c *Client) getHeartbeat() *protocol.Heartbeat {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.heartbeat
+}
+
+func (c *Client) setHeartbeat(heartbeat *protocol.Heartbeat) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.heartbeat = heartbeat
+}
+
+func (c *Client) runHeartbeat(ctx context.Context) {
+	err := c.heartbeat.Run(ctx, c.cmdConn)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "server declared dead %s", err.Error())
+	c.cmdConn.Close(ctx)
+}
+
+func (c *Client) listenCommands(ctx, tunnelCtx context.Context) error {
 	log := logger.GetLogger(ctx)
-	buf := make([]byte, 4096)
 	for {
 		select {
 		case <-ctx.Done():
@@ -46,76 +320,306 @@ func (c *Client) listenCommands(ctx context.Context) error {
 		default:
 		}
 
-		n, err := c.cmdConn.Read(buf)
+		frame, err := c.cmdConn.ReadFrame(ctx)
 		if err != nil {
 			return err
 		}
 
-		logger.MaybeDebugfContext(ctx, log, "new message from server")
-		if n < 0 {
-			continue
-		}
-
-		switch buf[0] {
-		case protocol.ClientHelloTypeData:
-			logger.MaybeDebugfContext(ctx, log, "Creating new data connection")
-			c.newDataConnection(ctx)
-		case protocol.TypeServerHello:
-			sh, err := protocol.ParseServerHelloBytes(buf[:n])
+		switch {
+		case frame.Type == protocol.TypePing:
+			err = c.cmdConn.WriteFrame(ctx, protocol.Pong(frame))
 			if err != nil {
-				logger.MaybeErrorfContext(ctx, log, "error parsing server hello %s", err.Error())
+				return err
+			}
+		case frame.Type == protocol.TypePong && c.heartbeat != nil:
+			err = c.heartbeat.HandlePong(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error handling pong %s", err.Error())
+			}
+		case frame.Type == protocol.TypeReject:
+			reject, err := protocol.ParseRejectFrame(frame)
+			if err != nil {
+				return err
+			}
+			return reject
+		case c.session != nil && mux.IsStreamFrame(frame.Type):
+			err = c.session.HandleFrame(ctx, frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error handling stream frame %s", err.Error())
+			}
+		case frame.Type == protocol.TypeDataConnRequest:
+			req, err := protocol.ParseDataConnRequestFrame(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error parsing data connection request %s", err.Error())
+				continue
+			}
+			f := c.forwardFor(req.Port)
+			if f == nil {
+				logger.MaybeErrorfContext(ctx, log, "data connection request %d for unknown port %d", req.RequestID, req.Port)
+				continue
+			}
+			logger.MaybeDebugfContext(ctx, log, "Creating new data connection for request %d", req.RequestID)
+			// the hello is built here as the next connection rewrites the ID
+			// and ports while data connections are still being dialed
+			hello := c.generateClientHello(protocol.ClientHelloTypeData, req.RequestID, f)
+			if req.Pooled {
+				go c.newPooledDataConnection(tunnelCtx, hello, f)
 				continue
 			}
-			logger.MaybeDebugfContext(ctx, log, "Got ID from server %s", sh.ID)
-			c.ID = sh.ID
+			go c.newDataConnection(tunnelCtx, hello, f)
 		default:
-			logger.MaybeErrorfContext(ctx, log, "unknown message type %s", buf[0])
+			logger.MaybeErrorfContext(ctx, log, "unknown message type %d", frame.Type)
 		}
+	}
+}
+
+func (c *Client) acceptStreams(ctx context.Context) {
+	log := logger.GetLogger(ctx)
+	for {
+		stream, err := c.session.Accept(ctx)
+		if err != nil {
+			return
+		}
+		var port uint16
+		if meta := stream.Meta(); len(meta) == 2 {
+			port = binary.BigEndian.Uint16(meta)
+		}
+		f := c.forwardFor(port)
+		if f == nil {
+			logger.MaybeErrorfContext(ctx, log, "stream %d for unknown port %d", stream.ID(), port)
+			stream.Close(ctx)
+			continue
+		}
+		logger.MaybeDebugfContext(ctx, log, "Accepted new stream %d", stream.ID())
+		go c.forward(ctx, stream, f)
+	}
+}
 
+// forwardFor returns the forward the server assigned the port, or the first
+// one for port zero as sent by servers without CapabilityForwards.
+func (c *Client) forwardFor(port uint16) *forward {
+	for _, f := range c.forwards {
+		if port == 0 || f.port == port {
+			return f
+		}
 	}
 	return nil
 }
 
-func (c *Client) newDataConnection(ctx context.Context) (net.Conn, error) {
-	log := logger.GetLogger(ctx)
-	dataConn, err := c.connect(ctx, protocol.ClientHelloTypeData)
+func (c *Client) newDataConnection(ctx context.Context, hello protocol.ClientHello, f *forward) (net.Conn, error) {
+	dataConn, _, err := c.connect(ctx, hello)
+	if err != nil {
+		return nil, err
+	}
+	err = c.forward(ctx, tcp.WrappedConn{Conn: dataConn}, f)
 	if err != nil {
 		return nil, err
 	}
+	return dataConn, nil
+}
 
-	logger.MaybeDebugfContext(ctx, log, "Dialing local port")
-	sconn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", c.config.ForwardPort), 5*time.Second)
+// newPooledDataConnection connects a data connection that idles until the
+// server activates it.
+func (c *Client) newPooledDataConnection(ctx context.Context, hello protocol.ClientHello, f *forward) error {
+	log := logger.GetLogger(ctx)
+	dataConn, _, err := c.connect(ctx, hello)
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, log, "Error creating pooled data connection %s", err.Error())
+		return err
+	}
+	activated := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			dataConn.Close()
+		case <-activated:
+		}
+	}()
+	frame, err := protocol.NewFrameReader(dataConn).ReadFrame()
+	close(activated)
 	if err != nil {
-		logger.MaybeErrorfContext(ctx, log, "error dialing local port %s", err.Error())
 		dataConn.Close()
-		return nil, err
+		return err
+	}
+	if frame.Type != protocol.TypeDataConnActivate {
+		dataConn.Close()
+		return fmt.Errorf("Unexpected message type %d on pooled data connection", frame.Type)
+	}
+	return c.forward(ctx, tcp.WrappedConn{Conn: dataConn}, f)
+}
+
+func (c *Client) forward(ctx context.Context, conn tcp.Conn, f *forward) error {
+	log := logger.GetLogger(ctx)
+	logger.MaybeDebugfContext(ctx, log, "Dialing local address %s", f.LocalAddress)
+	sconn, err := c.dialLocal(ctx, f, 5*time.Second)
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, log, "error dialing local port %s", err.Error())
+		conn.Close(ctx)
+		return err
 	}
-	tunnel := tcp.NewTunnel(tcp.WrappedConn{Conn: dataConn}, tcp.WrappedConn{Conn: sconn})
+	tunnel := tcp.NewTunnel(conn, tcp.WrappedConn{Conn: sconn})
 	go tunnel.Run(ctx)
-	return dataConn, nil
+	return nil
+}
+
+func (c *Client) dialLocal(ctx context.Context, f *forward, timeout time.Duration) (net.Conn, error) {
+	return tcp.Dial(ctx, f.LocalAddress, timeout, c.localRules(f.LocalAddress))
 }
 
-func (c *Client) connect(ctx context.Context, t byte) (net.Conn, error) {
+// localRules are the rules to dial a local address with. Fixed addresses were
+// checked against AllowedDestinations on start, hostnames are checked once
+// resolved.
+func (c *Client) localRules(address string) tcp.Rules {
+	if !tcp.ResolvedAtDial(address) {
+		return tcp.Rules{}
+	}
+	return c.destinations
+}
+
+func (c *Client) connect(ctx context.Context, hello protocol.ClientHello) (net.Conn, *protocol.ServerHello, error) {
 	log := logger.GetLogger(ctx)
 	logger.MaybeDebugfContext(ctx, log, "Dialing Server Address %s", c.config.ServerAddress)
-	conn, err := net.DialTimeout("tcp", c.config.ServerAddress, 5*time.Second)
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout := c.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	serverHello, err := c.handshake(conn, hello)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	logger.MaybeDebugfContext(ctx, log, "Established Connection with Server %s", c.config.ServerAddress)
+	return conn, serverHello, nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if c.tlsConfig == nil {
+		return dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+	}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}
+	return tlsDialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+}
+
+func (c *Client) handshake(conn net.Conn, hello protocol.ClientHello) (*protocol.ServerHello, error) {
+	sent := hello.Serialize()
+	_, err := conn.Write(sent)
 	if err != nil {
 		return nil, err
 	}
-	_, err = conn.Write(c.generateClientHello(t))
+	frames := protocol.NewFrameReader(conn)
+	frame, err := frames.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
-	logger.MaybeDebugfContext(ctx, log, "Established Connection with Server %s", c.config.ServerAddress)
-	return conn, nil
+	if frame.Type == protocol.TypeServerHello {
+		// the server skips the challenge when it has no secret and trusts our
+		// certificate alone, which only happens over TLS
+		return c.certificateHandshake(frame)
+	}
+	challenge, err := protocol.ParseChallengeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.config.Secret) == 0 {
+		return nil, fmt.Errorf("Server requires a secret")
+	}
+	nonce, err := protocol.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+	transcript := protocol.Transcript{
+		ServerNonce: challenge.Nonce,
+		ClientNonce: nonce,
+		ClientHello: sent,
+	}
+	response := protocol.ChallengeResponse{
+		Nonce: nonce,
+		Proof: transcript.ClientProof(c.config.Secret),
+	}
+	_, err = conn.Write(response.Frame().Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err = frames.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	serverHello, err := protocol.ParseServerHelloFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if !transcript.VerifyServerProof(c.config.Secret, *serverHello) {
+		return nil, fmt.Errorf("Server failed to prove it knows the secret")
+	}
+	return serverHello, c.checkVersion(serverHello)
+}
+
+func (c *Client) certificateHandshake(frame *protocol.Frame) (*protocol.ServerHello, error) {
+	serverHello, err := protocol.ParseServerHelloFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig == nil || len(serverHello.Proof) != 0 {
+		return nil, fmt.Errorf("Server skipped authentication without TLS")
+	}
+	return serverHello, c.checkVersion(serverHello)
 }
 
-func (c *Client) generateClientHello(t byte) []byte {
+func (c *Client) checkVersion(serverHello *protocol.ServerHello) error {
+	if serverHello.Version < protocol.MinProtocolVersion || serverHello.Version > protocol.ProtocolVersion {
+		return fmt.Errorf("Server chose unsupported protocol version %d", serverHello.Version)
+	}
+	return nil
+}
+
+func (c *Client) capabilities() protocol.Capabilities {
+	capabilities := protocol.SupportedCapabilities
+	if !c.config.Multiplex {
+		capabilities &^= protocol.CapabilityMultiplex
+	}
+	if c.config.DisableHealthCheck {
+		capabilities &^= protocol.CapabilityHealthCheck
+	}
+	return capabilities
+}
+
+// generateClientHello describes the forward, command hellos also describe
+// the rest of the forwards and data hellos are for the forward alone.
+func (c *Client) generateClientHello(t byte, requestID uint64, f *forward) protocol.ClientHello {
 	hello := protocol.ClientHello{
-		Type:   t,
-		ID:     c.ID,
-		Port:   c.config.RemotePort,
-		Secret: c.config.Secret,
+		Type:         t,
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   protocol.ProtocolVersion,
+		Capabilities: c.capabilities(),
+		ID:           c.id,
+		RequestID:    requestID,
+		Port:         f.remotePort(),
+		BindHost:     f.BindHost,
+
+		LoadBalancing: f.LoadBalancing,
+		Weight:        f.Weight,
+		Priority:      f.Priority,
+	}
+	if t != protocol.ClientHelloTypeCommand {
+		return hello
+	}
+	hello.ResumeToken = c.resumeToken
+	for _, other := range c.forwards[1:] {
+		hello.Forwards = append(hello.Forwards, protocol.Forward{
+			Port:          other.remotePort(),
+			BindHost:      other.BindHost,
+			LoadBalancing: other.LoadBalancing,
+			Weight:        other.Weight,
+			Priority:      other.Priority,
+		})
 	}
-	return hello.Serialize()
+	return hello
 }
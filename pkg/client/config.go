@@ -2,20 +2,153 @@ package client
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/blend/go-sdk/configutil"
 	"github.com/blend/go-sdk/logger"
 	"github.com/mat285/tcptunnel/pkg/config"
 )
 
+// DefaultHandshakeTimeout outlasts the server's default dial timeout, local
+// forwarding and SOCKS hellos are only answered once it has dialed.
+const DefaultHandshakeTimeout = 15 * time.Second
+
 type Config struct {
 	MaxConnections int
 
 	ServerAddress string
 	ForwardPort   uint16
-	LocalPort     uint16
-	RemotePort    uint16
-	Secret        []byte
+	// ForwardAddress is where connections are forwarded to instead of
+	// ForwardPort on localhost, any host:port or unix:/path/to/socket
+	ForwardAddress string
+
+	// LocalPort turns on local forwarding, like ssh -L. We listen on it and
+	// the server dials LocalDestination for each connection, if its policy
+	// allows. Without ForwardPort, ForwardAddress or Forwards nothing is
+	// exposed on the server.
+	LocalPort uint16
+	// LocalBindHost is the address LocalPort and SocksPort listen on,
+	// 127.0.0.1 if empty
+	LocalBindHost    string
+	LocalDestination string
+
+	// SocksPort runs a SOCKS5 proxy whose CONNECT requests the server dials,
+	// under the same policy as LocalDestination. Clients must authenticate
+	// when a username or password is set.
+	SocksPort     uint16
+	SocksUsername string
+	SocksPassword string
+
+	// UDPForwards expose local UDP services on the server, each over its own
+	// connection
+	UDPForwards []UDPForward
+
+	// RemotePort is the port the server listens on for us, the server
+	// assigns one if it is zero
+	RemotePort uint16
+	// BindHost asks the server to listen on a specific address, such as
+	// 127.0.0.1, if the server's policy allows it
+	BindHost string
+	Secret   []byte
+
+	// LoadBalancing asks the server for a strategy when we are the first
+	// client for the port
+	LoadBalancing string
+	// Weight and Priority place us among the other clients for the port
+	// under weighted and failover load balancing
+	Weight   uint16
+	Priority uint16
+
+	// Forwards are served together over one connection to the server, each
+	// on its own port. Without any, RemotePort is forwarded to ForwardPort
+	// with the options above.
+	Forwards []Forward
+	// AllowedDestinations limits the local addresses forwards may point at,
+	// each entry is unix:<glob> or <host>:<port> where host may be a CIDR
+	// range and port may be *. Anything is allowed when it is empty.
+	AllowedDestinations []string
+
+	TLS TLSConfig
+
+	// Multiplex carries tunnels as streams over the command connection
+	// instead of dialing a new data connection for each one
+	Multiplex bool
+
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+
+	// HandshakeTimeout bounds connecting to the server and the handshake,
+	// DefaultHandshakeTimeout if zero. It must be longer than the server's
+	// DialTimeout for its dial failures to reach local forwarding and SOCKS
+	// clients.
+	HandshakeTimeout time.Duration
+
+	// DisableReconnect makes Start return once the connection to the server
+	// is lost instead of reconnecting
+	DisableReconnect  bool
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	// DisableHealthCheck stops probing the forward address, the server then
+	// always routes to us
+	DisableHealthCheck  bool
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// TunnelBufferSize is how much tunnels copy at once when the kernel
+	// cannot copy between the sockets directly, tcp.DefaultBufferSize if zero
+	TunnelBufferSize int
+}
+
+// Forward serves a port on the server from a local address.
+type Forward struct {
+	// RemotePort is the port the server listens on, it assigns one if zero
+	RemotePort uint16
+	// LocalAddress is the host:port or unix:/path/to/socket connections
+	// are forwarded to, hostnames are resolved on every dial
+	LocalAddress string
+
+	BindHost      string
+	LoadBalancing string
+	Weight        uint16
+	Priority      uint16
+}
+
+// UDPForward serves a UDP port on the server from a local UDP address.
+type UDPForward struct {
+	// RemotePort is the port the server listens on, it must be set
+	RemotePort uint16
+	// LocalAddress is the host:port datagrams are sent to, each source on
+	// the server gets its own local socket so replies find their way back
+	LocalAddress string
+	BindHost     string
+}
+
+// HasForwards reports whether any TCP port is exposed on the server, clients
+// that only forward locally or over UDP need not register.
+func (c Config) HasForwards() bool {
+	return len(c.Forwards) > 0 || c.ForwardPort != 0 || len(c.ForwardAddress) > 0 || (c.LocalPort == 0 && c.SocksPort == 0 && len(c.UDPForwards) == 0)
+}
+
+// GetForwards returns the configured forwards, or the single forward
+// described by the top level fields.
+func (c Config) GetForwards() []Forward {
+	if len(c.Forwards) > 0 {
+		return c.Forwards
+	}
+	address := c.ForwardAddress
+	if len(address) == 0 {
+		address = fmt.Sprintf("127.0.0.1:%d", c.ForwardPort)
+	}
+	return []Forward{{
+		RemotePort:    c.RemotePort,
+		LocalAddress:  address,
+		BindHost:      c.BindHost,
+		LoadBalancing: c.LoadBalancing,
+		Weight:        c.Weight,
+		Priority:      c.Priority,
+	}}
 }
 
 // Resolve populates configuration fields from a variety of input sources
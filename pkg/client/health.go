@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+// runHealthCheck probes the forward's local address on an interval and
+// reports to the server each time the result changes.
+func (c *Client) runHealthCheck(ctx context.Context, f *forward) {
+	log := logger.GetLogger(ctx)
+	interval := c.config.HealthCheckInterval
+	if interval <= 0 {
+		interval = protocol.DefaultHealthCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last *protocol.HealthReport
+	for {
+		report := c.checkHealth(ctx, f)
+		if last == nil || report.Healthy != last.Healthy {
+			logger.MaybeInfofContext(ctx, log, "Local service %s is %s", f.LocalAddress, report)
+			err := c.cmdConn.WriteFrame(ctx, report.Frame())
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error sending health report %s", err.Error())
+				return
+			}
+			last = &report
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) checkHealth(ctx context.Context, f *forward) protocol.HealthReport {
+	timeout := c.config.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = protocol.DefaultHealthCheckTimeout
+	}
+	conn, err := c.dialLocal(ctx, f, timeout)
+	if err != nil {
+		return protocol.HealthReport{Port: c.reportPort(f), Reason: err.Error()}
+	}
+	conn.Close()
+	return protocol.HealthReport{Port: c.reportPort(f), Healthy: true}
+}
+
+// reportPort is the port health reports for the forward are sent for, servers
+// without CapabilityForwards only know the one.
+func (c *Client) reportPort(f *forward) uint16 {
+	if !c.serverCapabilities.Has(protocol.CapabilityForwards) {
+		return 0
+	}
+	return f.port
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/socks"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+// startLocalForwards starts local, SOCKS and UDP forwarding if they are
+// configured, the channel receives the result of the first to stop.
+func (c *Client) startLocalForwards(ctx context.Context) <-chan error {
+	errc := make(chan error, 2+len(c.config.UDPForwards))
+	start := func(name string, port uint16, handle func(context.Context, net.Conn)) {
+		go func() {
+			err := c.serveLocal(ctx, port, handle)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Error serving %s on port %d %s", name, port, err.Error())
+			}
+			errc <- err
+		}()
+	}
+	if c.config.LocalPort != 0 {
+		start("local forwarding", c.config.LocalPort, func(ctx context.Context, conn net.Conn) {
+			c.forwardLocal(ctx, conn, c.config.LocalDestination)
+		})
+	}
+	if c.config.SocksPort != 0 {
+		start("SOCKS", c.config.SocksPort, c.forwardSocks)
+	}
+	for _, f := range c.config.UDPForwards {
+		f := f
+		go func() {
+			err := c.runUDPForward(ctx, f)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Error forwarding UDP port %d %s", f.RemotePort, err.Error())
+			}
+			errc <- err
+		}()
+	}
+	return errc
+}
+
+// serveLocal listens on the port until the context is done and handles each
+// connection it accepts.
+func (c *Client) serveLocal(ctx context.Context, port uint16, handle func(context.Context, net.Conn)) error {
+	host := c.config.LocalBindHost
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	listener, err := tcp.Listen(ctx, host, port)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go handle(ctx, conn)
+	}
+}
+
+// forwardLocal carries the connection to the destination through the server.
+func (c *Client) forwardLocal(ctx context.Context, conn net.Conn, destination string) {
+	remote, err := c.dialThroughServer(ctx, destination)
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Error dialing %s through the server %s", destination, err.Error())
+		conn.Close()
+		return
+	}
+	tcp.NewTunnel(tcp.WrappedConn{Conn: conn}, tcp.WrappedConn{Conn: remote}).Run(ctx)
+}
+
+// forwardSocks reads the SOCKS request on the connection and carries it to
+// the requested destination through the server.
+func (c *Client) forwardSocks(ctx context.Context, conn net.Conn) {
+	log := logger.GetLogger(ctx)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	destination, err := socks.Handshake(conn, c.socksCredentials())
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, log, "Error reading SOCKS request from %s %s", conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	remote, err := c.dialThroughServer(ctx, destination)
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, log, "Error dialing %s through the server %s", destination, err.Error())
+		socks.Reply(conn, socksReply(err))
+		conn.Close()
+		return
+	}
+	err = socks.Reply(conn, socks.ReplySucceeded)
+	if err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	tcp.NewTunnel(tcp.WrappedConn{Conn: conn}, tcp.WrappedConn{Conn: remote}).Run(ctx)
+}
+
+func (c *Client) socksCredentials() *socks.Credentials {
+	if len(c.config.SocksUsername) == 0 && len(c.config.SocksPassword) == 0 {
+		return nil
+	}
+	return &socks.Credentials{
+		Username: c.config.SocksUsername,
+		Password: c.config.SocksPassword,
+	}
+}
+
+// socksReply tells the SOCKS client why the server could not connect it.
+func socksReply(err error) socks.ReplyCode {
+	var reject *protocol.RejectError
+	if !errors.As(err, &reject) {
+		return socks.ReplyGeneralFailure
+	}
+	switch reject.Code {
+	case protocol.RejectCodeDestinationDenied:
+		return socks.ReplyNotAllowed
+	case protocol.RejectCodeDialFailed:
+		return socks.ReplyHostUnreachable
+	default:
+		return socks.ReplyGeneralFailure
+	}
+}
+
+// dialThroughServer asks the server to dial the destination and returns the
+// connection carrying it.
+func (c *Client) dialThroughServer(ctx context.Context, destination string) (net.Conn, error) {
+	hello := protocol.ClientHello{
+		Type:         protocol.ClientHelloTypeDial,
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   protocol.ProtocolVersion,
+		Capabilities: c.capabilities(),
+		Destination:  destination,
+	}
+	conn, _, err := c.connect(ctx, hello)
+	return conn, err
+}
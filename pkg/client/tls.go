@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type TLSConfig struct {
+	Enabled bool
+
+	// CAFile is a PEM bundle of CAs to trust instead of the system roots
+	CAFile string
+	// ServerName overrides the name the server certificate is verified
+	// against, it defaults to the host of the server address
+	ServerName string
+	// PinnedSHA256 is the hex SHA-256 fingerprint of the server certificate.
+	// When set without a CAFile only the pin is checked, which allows self
+	// signed server certificates
+	PinnedSHA256 string
+	// CertFile and KeyFile are the PEM client certificate and key presented
+	// to servers that authenticate clients by certificate
+	CertFile string
+	KeyFile  string
+}
+
+func (c TLSConfig) HasClientCert() bool {
+	return c.Enabled && len(c.CertFile) > 0
+}
+
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(c.CAFile) > 0 {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(c.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.PinnedSHA256) > 0 {
+		pin, err := hex.DecodeString(strings.ReplaceAll(c.PinnedSHA256, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("Invalid certificate pin %s", c.PinnedSHA256)
+		}
+		// chain verification is still done by the standard library when a CA is
+		// configured, the pin is checked on top of it
+		cfg.InsecureSkipVerify = len(c.CAFile) == 0
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("Server presented no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("Server certificate does not match pin")
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for localhost and a PEM file holding it.
+func selfSigned(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, file
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	cert, caFile := selfSigned(t)
+	sum := sha256.Sum256(cert.Certificate[0])
+	pin := hex.EncodeToString(sum[:])
+	_, otherCAFile := selfSigned(t)
+	otherPin := hex.EncodeToString(make([]byte, sha256.Size))
+
+	for _, c := range []struct {
+		name      string
+		config    TLSConfig
+		invalid   bool
+		connected bool
+	}{
+		{name: "pin only", config: TLSConfig{PinnedSHA256: pin}, connected: true},
+		{name: "pin with colons", config: TLSConfig{PinnedSHA256: pin[:2] + ":" + pin[2:]}, connected: true},
+		{name: "wrong pin", config: TLSConfig{PinnedSHA256: otherPin}},
+		{name: "ca", config: TLSConfig{CAFile: caFile, ServerName: "localhost"}, connected: true},
+		{name: "ca and pin", config: TLSConfig{CAFile: caFile, ServerName: "localhost", PinnedSHA256: pin}, connected: true},
+		{name: "ca and wrong pin", config: TLSConfig{CAFile: caFile, ServerName: "localhost", PinnedSHA256: otherPin}},
+		{name: "ca with wrong name", config: TLSConfig{CAFile: caFile, ServerName: "example.com"}},
+		{name: "untrusted ca", config: TLSConfig{CAFile: otherCAFile, ServerName: "localhost"}},
+		{name: "system roots", config: TLSConfig{ServerName: "localhost"}},
+		{name: "malformed pin", config: TLSConfig{PinnedSHA256: "abc"}, invalid: true},
+		{name: "missing ca file", config: TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, invalid: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := c.config.ClientConfig()
+			if (err != nil) != c.invalid {
+				t.Fatalf("config error %v", err)
+			}
+			if c.invalid {
+				return
+			}
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			go server.Handshake()
+			err = tls.Client(clientConn, cfg).Handshake()
+			if (err == nil) != c.connected {
+				t.Fatalf("connected %v want %v %v", err == nil, c.connected, err)
+			}
+		})
+	}
+}
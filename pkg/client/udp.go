@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+// runUDPForward serves the UDP forward until the context is done, lost
+// connections are reestablished like the command connection's.
+func (c *Client) runUDPForward(ctx context.Context, f UDPForward) error {
+	log := logger.GetLogger(ctx)
+	backoff := NewBackoff(c.config.ReconnectMinDelay, c.config.ReconnectMaxDelay)
+	var resumeToken []byte
+	var registered bool
+	for {
+		connected, err := c.serveUDP(ctx, f, &resumeToken)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// the server may not have noticed our previous connection is gone
+		// yet, without a resume token we wait for it to
+		var reject *protocol.RejectError
+		heldByUs := registered && errors.As(err, &reject) && reject.Code == protocol.RejectCodePortInUse
+		if c.config.DisableReconnect || !(retryable(err) || heldByUs) {
+			return err
+		}
+		if connected {
+			registered = true
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		logger.MaybeErrorfContext(ctx, log, "Error forwarding UDP port %d %s, retrying in %s", f.RemotePort, err.Error(), delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// serveUDP registers the UDP port with the server and replays its datagrams
+// to the local address until the connection fails, connected is false if it
+// could not be established. The resume token of the previous connection is
+// presented and replaced with the new one.
+func (c *Client) serveUDP(ctx context.Context, f UDPForward, resumeToken *[]byte) (connected bool, err error) {
+	log := logger.GetLogger(ctx)
+	hello := protocol.ClientHello{
+		Type:         protocol.ClientHelloTypeUDP,
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   protocol.ProtocolVersion,
+		Capabilities: c.capabilities(),
+		Port:         f.RemotePort,
+		BindHost:     f.BindHost,
+		ResumeToken:  *resumeToken,
+	}
+	conn, serverHello, err := c.connect(ctx, hello)
+	if err != nil {
+		return false, err
+	}
+	*resumeToken = serverHello.ResumeToken
+	logger.MaybeInfofContext(ctx, log, "Server is listening for us on UDP port %d forwarding to %s", serverHello.Port, f.LocalAddress)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	relay := &udpRelay{
+		client:   c,
+		forward:  f,
+		cmdConn:  protocol.NewCmdConn(conn),
+		sessions: make(map[uint32]*udpLocal),
+	}
+	defer relay.close()
+	go func() {
+		<-ctx.Done()
+		relay.cmdConn.Close(ctx)
+	}()
+	if serverHello.Capabilities.Has(protocol.CapabilityHeartbeat) {
+		relay.heartbeat = protocol.NewHeartbeat(c.config.HeartbeatInterval, c.config.HeartbeatMaxMissed)
+		go func() {
+			err := relay.heartbeat.Run(ctx, relay.cmdConn)
+			if err != nil && ctx.Err() == nil {
+				logger.MaybeErrorfContext(ctx, log, "server declared dead %s", err.Error())
+				relay.cmdConn.Close(ctx)
+			}
+		}()
+	}
+	return true, relay.run(ctx)
+}
+
+// udpRelay replays the datagrams of one UDP forward, each session the server
+// reports gets its own local socket.
+type udpRelay struct {
+	client    *Client
+	forward   UDPForward
+	cmdConn   *protocol.CmdConn
+	heartbeat *protocol.Heartbeat
+
+	lock     sync.Mutex
+	sessions map[uint32]*udpLocal
+}
+
+// udpLocal is the local socket of a session, datagrams wait in pending
+// until it is dialed.
+type udpLocal struct {
+	conn    net.Conn
+	pending [][]byte
+}
+
+// maxPendingDatagrams bounds what is held for a session while its socket is
+// dialed, later datagrams are dropped as the network would.
+const maxPendingDatagrams = 64
+
+func (r *udpRelay) run(ctx context.Context) error {
+	log := logger.GetLogger(ctx)
+	for {
+		frame, err := r.cmdConn.ReadFrame(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case frame.Type == protocol.TypeDatagram:
+			datagram, err := protocol.ParseDatagramFrame(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error parsing datagram %s", err.Error())
+				continue
+			}
+			r.deliver(ctx, datagram)
+		case frame.Type == protocol.TypeDatagramClose:
+			datagramClose, err := protocol.ParseDatagramCloseFrame(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error parsing datagram close %s", err.Error())
+				continue
+			}
+			r.closeSession(datagramClose.Session)
+		case frame.Type == protocol.TypePing:
+			err = r.cmdConn.WriteFrame(ctx, protocol.Pong(frame))
+			if err != nil {
+				return err
+			}
+		case frame.Type == protocol.TypePong && r.heartbeat != nil:
+			err = r.heartbeat.HandlePong(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "error handling pong %s", err.Error())
+			}
+		case frame.Type == protocol.TypeReject:
+			reject, err := protocol.ParseRejectFrame(frame)
+			if err != nil {
+				return err
+			}
+			return reject
+		default:
+			logger.MaybeErrorfContext(ctx, log, "unknown message type %d", frame.Type)
+		}
+	}
+}
+
+// deliver writes the datagram to the local socket of its session, dialing
+// one for new sessions without holding up the other sessions.
+func (r *udpRelay) deliver(ctx context.Context, datagram *protocol.Datagram) {
+	r.lock.Lock()
+	local, has := r.sessions[datagram.Session]
+	if !has {
+		local = &udpLocal{}
+		r.sessions[datagram.Session] = local
+		go r.dial(ctx, datagram.Session, local)
+	}
+	if local.conn == nil {
+		if len(local.pending) < maxPendingDatagrams {
+			local.pending = append(local.pending, datagram.Data)
+		}
+		r.lock.Unlock()
+		return
+	}
+	r.lock.Unlock()
+	r.write(ctx, local.conn, datagram.Data)
+}
+
+func (r *udpRelay) write(ctx context.Context, conn net.Conn, data []byte) {
+	_, err := conn.Write(data)
+	if err != nil {
+		logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "error writing datagram to %s %s", r.forward.LocalAddress, err.Error())
+	}
+}
+
+// dial connects the session's local socket and sends what it receives back
+// to the server until the socket is closed.
+func (r *udpRelay) dial(ctx context.Context, session uint32, local *udpLocal) {
+	log := logger.GetLogger(ctx)
+	conn, err := tcp.DialUDP(ctx, r.forward.LocalAddress, 5*time.Second, r.client.localRules(r.forward.LocalAddress))
+	r.lock.Lock()
+	if err != nil {
+		// the next datagram of the session dials again
+		if r.sessions[session] == local {
+			delete(r.sessions, session)
+		}
+		r.lock.Unlock()
+		logger.MaybeErrorfContext(ctx, log, "error dialing %s %s", r.forward.LocalAddress, err.Error())
+		return
+	}
+	if r.sessions[session] != local {
+		// the session was closed while dialing
+		r.lock.Unlock()
+		conn.Close()
+		return
+	}
+	local.conn = conn
+	pending := local.pending
+	local.pending = nil
+	r.lock.Unlock()
+	for _, data := range pending {
+		r.write(ctx, conn, data)
+	}
+
+	buf := make([]byte, protocol.MaxDatagramLength)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		err = r.cmdConn.WriteFrame(ctx, protocol.Datagram{Session: session, Data: data}.Frame())
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *udpRelay) closeSession(session uint32) {
+	r.lock.Lock()
+	local := r.sessions[session]
+	delete(r.sessions, session)
+	r.lock.Unlock()
+	if local != nil && local.conn != nil {
+		local.conn.Close()
+	}
+}
+
+func (r *udpRelay) close() {
+	r.lock.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[uint32]*udpLocal)
+	r.lock.Unlock()
+	for _, local := range sessions {
+		if local.conn != nil {
+			local.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+const (
+	DefaultWindowSize = 256 * 1024
+
+	maxDataLength = 32 * 1024
+	acceptBacklog = 256
+)
+
+// Session multiplexes streams over a single framed connection. The owner of
+// the connection reads frames and hands stream frames to HandleFrame.
+type Session struct {
+	sender protocol.FrameSender
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	accept chan *Stream
+	closed chan struct{}
+	err    error
+}
+
+// NewSession creates a session over the sender. The two ends of a connection
+// must pass different values for client so their stream IDs never collide.
+func NewSession(sender protocol.FrameSender, client bool) *Session {
+	nextID := uint32(1)
+	if client {
+		nextID = 2
+	}
+	return &Session{
+		sender:  sender,
+		streams: make(map[uint32]*Stream),
+		nextID:  nextID,
+		accept:  make(chan *Stream, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+}
+
+func IsStreamFrame(t byte) bool {
+	return t >= protocol.TypeStreamOpen && t <= protocol.TypeStreamReset
+}
+
+func (s *Session) Open(ctx context.Context) (*Stream, error) {
+	return s.OpenWith(ctx, nil)
+}
+
+// OpenWith opens a stream the peer can tell apart from others by meta, which
+// it reads from Stream.Meta.
+func (s *Session) OpenWith(ctx context.Context, meta []byte) (*Stream, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(id, s)
+	stream.meta = meta
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	err := s.send(ctx, protocol.TypeStreamOpen, id, meta)
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, s.err
+	case stream := <-s.accept:
+		return stream, nil
+	}
+}
+
+// Done is closed once the session has been closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) Close(err error) {
+	if err == nil {
+		err = fmt.Errorf("Session closed")
+	}
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.closed)
+	s.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.setReset(err)
+	}
+}
+
+func (s *Session) HandleFrame(ctx context.Context, frame *protocol.Frame) error {
+	if len(frame.Payload) < 4 {
+		return fmt.Errorf("Malformed stream frame")
+	}
+	id := binary.BigEndian.Uint32(frame.Payload[0:4])
+	payload := frame.Payload[4:]
+
+	if frame.Type == protocol.TypeStreamOpen {
+		return s.handleOpen(ctx, id, payload)
+	}
+
+	s.lock.Lock()
+	stream := s.streams[id]
+	s.lock.Unlock()
+	if stream == nil {
+		if frame.Type == protocol.TypeStreamData {
+			return s.send(ctx, protocol.TypeStreamReset, id, nil)
+		}
+		return nil
+	}
+
+	switch frame.Type {
+	case protocol.TypeStreamData:
+		if !stream.receive(payload) {
+			s.remove(id)
+			stream.setReset(fmt.Errorf("Stream flow control window exceeded"))
+			return s.send(ctx, protocol.TypeStreamReset, id, nil)
+		}
+	case protocol.TypeStreamWindow:
+		if len(payload) < 4 {
+			return fmt.Errorf("Malformed stream window update")
+		}
+		stream.addSendWindow(binary.BigEndian.Uint32(payload))
+	case protocol.TypeStreamClose:
+		if stream.remoteClose() {
+			s.remove(id)
+		}
+	case protocol.TypeStreamReset:
+		s.remove(id)
+		stream.setReset(fmt.Errorf("Stream reset by peer"))
+	default:
+		return fmt.Errorf("Unknown stream frame type %d", frame.Type)
+	}
+	return nil
+}
+
+func (s *Session) handleOpen(ctx context.Context, id uint32, meta []byte) error {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return s.err
+	}
+	if _, has := s.streams[id]; has {
+		s.lock.Unlock()
+		return fmt.Errorf("Duplicate stream id %d", id)
+	}
+	stream := newStream(id, s)
+	stream.meta = meta
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	select {
+	case s.accept <- stream:
+		return nil
+	default:
+		s.remove(id)
+		return s.send(ctx, protocol.TypeStreamReset, id, nil)
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) send(ctx context.Context, t byte, id uint32, payload []byte) error {
+	buf := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, id)
+	return s.sender.WriteFrame(ctx, protocol.Frame{
+		Type:    t,
+		Payload: append(buf, payload...),
+	})
+}
+
+func (s *Session) sendWindowUpdate(ctx context.Context, id uint32, n uint32) error {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, n)
+	return s.send(ctx, protocol.TypeStreamWindow, id, buf)
+}
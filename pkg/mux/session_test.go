@@ -0,0 +1,324 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+// pipe hands every frame straight to the peer session.
+type pipe struct {
+	peer *Session
+}
+
+func (p *pipe) WriteFrame(ctx context.Context, frame protocol.Frame) error {
+	return p.peer.HandleFrame(ctx, &frame)
+}
+
+// recorder keeps the frames a session sends.
+type recorder struct {
+	lock   sync.Mutex
+	frames []protocol.Frame
+}
+
+func (r *recorder) WriteFrame(ctx context.Context, frame protocol.Frame) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.frames = append(r.frames, frame)
+	return nil
+}
+
+func (r *recorder) last() protocol.Frame {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.frames[len(r.frames)-1]
+}
+
+func newPair() (*Session, *Session) {
+	clientPipe, serverPipe := &pipe{}, &pipe{}
+	client := NewSession(clientPipe, true)
+	server := NewSession(serverPipe, false)
+	clientPipe.peer, serverPipe.peer = server, client
+	return client, server
+}
+
+func streamFrame(t byte, id uint32, payload []byte) *protocol.Frame {
+	buf := binary.BigEndian.AppendUint32(nil, id)
+	return &protocol.Frame{Type: t, Payload: append(buf, payload...)}
+}
+
+func openPair(t *testing.T, ctx context.Context) (*Stream, *Stream) {
+	client, server := newPair()
+	opened, err := client.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened, accepted
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	opened, accepted := openPair(t, ctx)
+	if opened.ID()%2 != 0 || accepted.ID() != opened.ID() {
+		t.Fatalf("client stream %d accepted as %d", opened.ID(), accepted.ID())
+	}
+	err := opened.Write(ctx, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := accepted.Read(ctx, buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+	err = accepted.Write(ctx, []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = opened.Read(ctx, buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("read %q %v", buf[:n], err)
+	}
+}
+
+func TestStreamMeta(t *testing.T) {
+	ctx := context.Background()
+	for _, meta := range [][]byte{nil, {0x1f, 0x90}} {
+		client, server := newPair()
+		opened, err := client.OpenWith(ctx, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := server.Accept(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened.Meta(), meta) || !bytes.Equal(accepted.Meta(), meta) {
+			t.Fatalf("opened with %v accepted with %v want %v", opened.Meta(), accepted.Meta(), meta)
+		}
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	ctx := context.Background()
+	opened, accepted := openPair(t, ctx)
+	data := make([]byte, 2*DefaultWindowSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- opened.Write(ctx, data)
+	}()
+
+	// the writer stops once it has used up the window
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("write finished without a window update %v", err)
+	default:
+	}
+	accepted.lock.Lock()
+	buffered := accepted.readBuf.Len()
+	accepted.lock.Unlock()
+	if buffered != DefaultWindowSize {
+		t.Fatalf("buffered %d want %d", buffered, DefaultWindowSize)
+	}
+
+	// reading grants more window until everything arrives
+	received := make([]byte, 0, len(data))
+	buf := make([]byte, 8*1024)
+	for len(received) < len(data) {
+		n, err := accepted.Read(ctx, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	ctx := context.Background()
+	sender := &recorder{}
+	session := NewSession(sender, false)
+	err := session.HandleFrame(ctx, streamFrame(protocol.TypeStreamOpen, 2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.HandleFrame(ctx, streamFrame(protocol.TypeStreamData, 2, make([]byte, DefaultWindowSize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame := sender.last(); frame.Type != protocol.TypeStreamReset {
+		t.Fatalf("sent frame type %d", frame.Type)
+	}
+	_, err = stream.Read(ctx, make([]byte, 1))
+	if err == nil {
+		t.Fatal("read from a reset stream")
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	ctx := context.Background()
+	opened, accepted := openPair(t, ctx)
+	err := accepted.session.send(ctx, protocol.TypeStreamReset, accepted.ID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = opened.Read(ctx, make([]byte, 1))
+	if err == nil {
+		t.Fatal("read from a reset stream")
+	}
+	err = opened.Write(ctx, []byte("x"))
+	if err == nil {
+		t.Fatal("write to a reset stream")
+	}
+}
+
+func TestUnknownStreamIsReset(t *testing.T) {
+	ctx := context.Background()
+	sender := &recorder{}
+	session := NewSession(sender, false)
+	err := session.HandleFrame(ctx, streamFrame(protocol.TypeStreamData, 7, []byte("x")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := sender.last()
+	if frame.Type != protocol.TypeStreamReset || binary.BigEndian.Uint32(frame.Payload) != 7 {
+		t.Fatalf("sent %+v", frame)
+	}
+}
+
+func TestSessionCloseResetsStreams(t *testing.T) {
+	ctx := context.Background()
+	opened, _ := openPair(t, ctx)
+	opened.session.Close(nil)
+	_, err := opened.Read(ctx, make([]byte, 1))
+	if err == nil {
+		t.Fatal("read from a stream of a closed session")
+	}
+	_, err = opened.session.Open(ctx)
+	if err == nil {
+		t.Fatal("opened a stream on a closed session")
+	}
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	ctx := context.Background()
+	opened, accepted := openPair(t, ctx)
+	err := opened.Write(ctx, []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = opened.CloseWrite(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Write(ctx, []byte("x")) == nil {
+		t.Fatal("wrote after CloseWrite")
+	}
+	request, err := readAll(ctx, accepted)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("read %q %v", request, err)
+	}
+
+	// the other direction keeps working until it is closed too
+	err = accepted.Write(ctx, []byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = accepted.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := readAll(ctx, opened)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("read %q %v", response, err)
+	}
+}
+
+func TestStreamCloseAfterCloseWrite(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		closeWrite bool
+		// peer is what the peer sends before the stream is closed, if
+		// anything
+		peer byte
+		want []byte
+	}{
+		{name: "close", want: []byte{protocol.TypeStreamOpen, protocol.TypeStreamClose}},
+		{name: "peer still writing", closeWrite: true, want: []byte{protocol.TypeStreamOpen, protocol.TypeStreamClose, protocol.TypeStreamReset}},
+		{name: "peer done writing", closeWrite: true, peer: protocol.TypeStreamClose, want: []byte{protocol.TypeStreamOpen, protocol.TypeStreamClose}},
+		{name: "reset by peer", closeWrite: true, peer: protocol.TypeStreamReset, want: []byte{protocol.TypeStreamOpen, protocol.TypeStreamClose}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			sender := &recorder{}
+			session := NewSession(sender, true)
+			stream, err := session.Open(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.closeWrite {
+				if err := stream.CloseWrite(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.peer != 0 {
+				if err := session.HandleFrame(ctx, streamFrame(c.peer, stream.ID(), nil)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := stream.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			sender.lock.Lock()
+			defer sender.lock.Unlock()
+			got := make([]byte, len(sender.frames))
+			for i, frame := range sender.frames {
+				got[i] = frame.Type
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("sent %v want %v", got, c.want)
+			}
+			if session.streams[stream.ID()] != nil {
+				t.Fatal("stream not removed")
+			}
+		})
+	}
+}
+
+func readAll(ctx context.Context, stream *Stream) ([]byte, error) {
+	var out []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := stream.Read(ctx, buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
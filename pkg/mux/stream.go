@@ -0,0 +1,242 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+// Stream is one multiplexed connection within a Session. Each direction has
+// its own flow control window, the receiver grants more window as the
+// application reads.
+type Stream struct {
+	id      uint32
+	session *Session
+	meta    []byte
+
+	lock         sync.Mutex
+	state        tcp.ConnState
+	readBuf      bytes.Buffer
+	recvWindow   uint32
+	consumed     uint32
+	sendWindow   uint32
+	remoteClosed bool
+	localClosed  bool
+	writeClosed  bool
+	reset        error
+
+	readReady   chan struct{}
+	windowReady chan struct{}
+}
+
+var _ tcp.Conn = (*Stream)(nil)
+
+func newStream(id uint32, session *Session) *Stream {
+	return &Stream{
+		id:          id,
+		session:     session,
+		state:       tcp.ConnStateOpen,
+		recvWindow:  DefaultWindowSize,
+		sendWindow:  DefaultWindowSize,
+		readReady:   make(chan struct{}, 1),
+		windowReady: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Meta is what the stream was opened with, nil if nothing.
+func (s *Stream) Meta() []byte {
+	return s.meta
+}
+
+func (s *Stream) Read(ctx context.Context, buf []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.readBuf.Len() > 0 {
+			n, _ := s.readBuf.Read(buf)
+			s.consumed += uint32(n)
+			update := uint32(0)
+			if s.consumed >= DefaultWindowSize/2 && !s.remoteClosed {
+				update = s.consumed
+				s.recvWindow += update
+				s.consumed = 0
+			}
+			s.lock.Unlock()
+			if update > 0 {
+				err := s.session.sendWindowUpdate(ctx, s.id, update)
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+		if s.reset != nil {
+			err := s.reset
+			s.lock.Unlock()
+			return 0, err
+		}
+		if s.remoteClosed {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+		if s.localClosed {
+			s.lock.Unlock()
+			return 0, fmt.Errorf("Stream closed")
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-s.readReady:
+		}
+	}
+}
+
+func (s *Stream) Write(ctx context.Context, data []byte) error {
+	for len(data) > 0 {
+		s.lock.Lock()
+		if s.reset != nil {
+			err := s.reset
+			s.lock.Unlock()
+			return err
+		}
+		if s.localClosed || s.writeClosed {
+			s.lock.Unlock()
+			return fmt.Errorf("Stream closed")
+		}
+		if s.sendWindow == 0 {
+			s.lock.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-s.windowReady:
+			}
+			continue
+		}
+		n := len(data)
+		if n > maxDataLength {
+			n = maxDataLength
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.lock.Unlock()
+
+		err := s.session.send(ctx, protocol.TypeStreamData, s.id, data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *Stream) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if s.state == tcp.ConnStateClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.state = tcp.ConnStateClosed
+	sendClose := !s.localClosed && !s.writeClosed && s.reset == nil
+	// after CloseWrite the peer may still be writing, it is told nobody will
+	// read it
+	sendReset := s.writeClosed && !s.remoteClosed && s.reset == nil
+	s.localClosed = true
+	s.lock.Unlock()
+	notify(s.readReady)
+	notify(s.windowReady)
+
+	s.session.remove(s.id)
+	switch {
+	case sendClose:
+		return s.session.send(ctx, protocol.TypeStreamClose, s.id, nil)
+	case sendReset:
+		return s.session.send(ctx, protocol.TypeStreamReset, s.id, nil)
+	default:
+		return nil
+	}
+}
+
+// CloseWrite sends the peer EOF, the stream can still be read until the peer
+// closes its side.
+func (s *Stream) CloseWrite(ctx context.Context) error {
+	s.lock.Lock()
+	if s.localClosed || s.writeClosed || s.reset != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	removed := s.remoteClosed
+	s.lock.Unlock()
+	notify(s.windowReady)
+
+	if removed {
+		s.session.remove(s.id)
+	}
+	return s.session.send(ctx, protocol.TypeStreamClose, s.id, nil)
+}
+
+func (s *Stream) State() tcp.ConnState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+func (s *Stream) receive(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if uint32(len(data)) > s.recvWindow {
+		return false
+	}
+	s.recvWindow -= uint32(len(data))
+	if !s.localClosed {
+		s.readBuf.Write(data)
+	}
+	notify(s.readReady)
+	return true
+}
+
+func (s *Stream) addSendWindow(n uint32) {
+	s.lock.Lock()
+	s.sendWindow += n
+	s.lock.Unlock()
+	notify(s.windowReady)
+}
+
+// remoteClose marks the peer as done writing and reports whether both sides
+// are now closed.
+func (s *Stream) remoteClose() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remoteClosed = true
+	notify(s.readReady)
+	return s.localClosed || s.writeClosed
+}
+
+func (s *Stream) setReset(err error) {
+	s.lock.Lock()
+	if s.reset == nil {
+		s.reset = err
+	}
+	s.lock.Unlock()
+	notify(s.readReady)
+	notify(s.windowReady)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
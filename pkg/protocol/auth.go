@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Connections are authenticated with a challenge-response over the shared
+// secret, which is never sent on the wire:
+//
+//	client -> ClientHello
+//	server -> Challenge{server nonce}
+//	client -> ChallengeResponse{client nonce, HMAC(secret, client label | transcript)}
+//	server -> ServerHello{..., HMAC(secret, server label | transcript | server hello)}
+const (
+	NonceLength = 32
+	ProofLength = sha256.Size
+
+	clientProofLabel = "tcptunnel client proof"
+	serverProofLabel = "tcptunnel server proof"
+)
+
+type Challenge struct {
+	Nonce []byte
+}
+
+type ChallengeResponse struct {
+	Nonce []byte
+	Proof []byte
+}
+
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceLength)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func ParseChallengeFrame(frame *Frame) (*Challenge, error) {
+	if frame.Type == TypeReject {
+		reject, err := ParseRejectFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		return nil, reject
+	}
+	if frame.Type != TypeChallenge || len(frame.Payload) != NonceLength {
+		return nil, fmt.Errorf("Malformed challenge")
+	}
+	return &Challenge{Nonce: frame.Payload}, nil
+}
+
+func (c Challenge) Frame() Frame {
+	return Frame{
+		Type:    TypeChallenge,
+		Payload: c.Nonce,
+	}
+}
+
+func ParseChallengeResponseFrame(frame *Frame) (*ChallengeResponse, error) {
+	if frame.Type != TypeChallengeResponse || len(frame.Payload) != NonceLength+ProofLength {
+		return nil, fmt.Errorf("Malformed challenge response")
+	}
+	return &ChallengeResponse{
+		Nonce: frame.Payload[:NonceLength],
+		Proof: frame.Payload[NonceLength:],
+	}, nil
+}
+
+func (c ChallengeResponse) Frame() Frame {
+	e := encoder{}
+	e.raw(c.Nonce)
+	e.raw(c.Proof)
+	return Frame{
+		Type:    TypeChallengeResponse,
+		Payload: e.buf,
+	}
+}
+
+// Transcript is everything both sides have seen before proving knowledge of
+// the secret, binding each proof to this handshake.
+type Transcript struct {
+	ServerNonce []byte
+	ClientNonce []byte
+	// ClientHello is the serialized hello frame exactly as it was sent, so
+	// options the server does not understand are covered too
+	ClientHello []byte
+}
+
+func (t Transcript) ClientProof(secret []byte) []byte {
+	return t.mac(secret, clientProofLabel)
+}
+
+// ServerProof covers the server hello too so its fields cannot be altered on
+// the way to the client.
+func (t Transcript) ServerProof(secret []byte, hello ServerHello) []byte {
+	hello.Proof = nil
+	return t.mac(secret, serverProofLabel, hello.Frame().Payload)
+}
+
+func (t Transcript) VerifyClientProof(secret, proof []byte) bool {
+	return hmac.Equal(t.ClientProof(secret), proof)
+}
+
+func (t Transcript) VerifyServerProof(secret []byte, hello ServerHello) bool {
+	return hmac.Equal(t.ServerProof(secret, hello), hello.Proof)
+}
+
+func (t Transcript) mac(secret []byte, label string, extra ...[]byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(label))
+	h.Write(t.ServerNonce)
+	h.Write(t.ClientNonce)
+	h.Write(t.ClientHello)
+	for _, e := range extra {
+		h.Write(e)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func handshakeTranscripts(t *testing.T, sent []byte) (Transcript, Transcript) {
+	t.Helper()
+	received, err := NewFrameReader(bytes.NewReader(sent)).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverNonce, _ := NewNonce()
+	clientNonce, _ := NewNonce()
+	client := Transcript{ServerNonce: serverNonce, ClientNonce: clientNonce, ClientHello: sent}
+	server := Transcript{ServerNonce: serverNonce, ClientNonce: clientNonce, ClientHello: received.Serialize()}
+	return client, server
+}
+
+func TestTranscriptProofs(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	hello := ClientHello{Type: ClientHelloTypeCommand, MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Port: 80}
+	client, server := handshakeTranscripts(t, hello.Serialize())
+	if !server.VerifyClientProof(secret, client.ClientProof(secret)) {
+		t.Fatal("client proof rejected")
+	}
+	if server.VerifyClientProof([]byte("another secret of thirty-two by"), client.ClientProof(secret)) {
+		t.Fatal("client proof accepted for another secret")
+	}
+	serverHello := ServerHello{Type: TypeServerHello, Version: ProtocolVersion, Port: 80}
+	serverHello.Proof = server.ServerProof(secret, serverHello)
+	if !client.VerifyServerProof(secret, serverHello) {
+		t.Fatal("server proof rejected")
+	}
+	serverHello.Port = 81
+	if client.VerifyServerProof(secret, serverHello) {
+		t.Fatal("server proof accepted for an altered hello")
+	}
+}
+
+func TestTranscriptCoversHelloAsSent(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	hello := ClientHello{Type: ClientHelloTypeCommand, MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Port: 80}
+	frame := hello.Frame()
+	// an option from a newer client the parser skips
+	frame.Payload = append(frame.Payload, 200, 1, 1)
+	sent := frame.Serialize()
+	client, server := handshakeTranscripts(t, sent)
+	if !server.VerifyClientProof(secret, client.ClientProof(secret)) {
+		t.Fatal("client proof rejected for a hello with an unknown option")
+	}
+
+	// the proof breaks if the option or the hello type is altered
+	stripped := hello.Serialize()
+	_, altered := handshakeTranscripts(t, stripped)
+	altered.ServerNonce, altered.ClientNonce = client.ServerNonce, client.ClientNonce
+	if altered.VerifyClientProof(secret, client.ClientProof(secret)) {
+		t.Fatal("client proof accepted without the option")
+	}
+	retyped := append([]byte(nil), sent...)
+	retyped[0] = ClientHelloTypeData
+	_, altered = handshakeTranscripts(t, retyped)
+	altered.ServerNonce, altered.ClientNonce = client.ServerNonce, client.ClientNonce
+	if altered.VerifyClientProof(secret, client.ClientProof(secret)) {
+		t.Fatal("client proof accepted for another hello type")
+	}
+}
@@ -5,21 +5,32 @@ import (
 	"net"
 )
 
+// FrameSender is the write half of a framed connection
+type FrameSender interface {
+	WriteFrame(context.Context, Frame) error
+}
+
 type CmdConn struct {
 	net.Conn
+
+	reader *FrameReader
+	writer *FrameWriter
 }
 
 func NewCmdConn(conn net.Conn) *CmdConn {
-	return &CmdConn{Conn: conn}
+	return &CmdConn{
+		Conn:   conn,
+		reader: NewFrameReader(conn),
+		writer: NewFrameWriter(conn),
+	}
 }
 
-func (c *CmdConn) Write(ctx context.Context, data []byte) error {
-	_, err := c.Conn.Write(data)
-	return err
+func (c *CmdConn) WriteFrame(ctx context.Context, frame Frame) error {
+	return c.writer.WriteFrame(frame)
 }
 
-func (c *CmdConn) Read(ctx context.Context, buf []byte) (int, error) {
-	return c.Conn.Read(buf)
+func (c *CmdConn) ReadFrame(ctx context.Context) (*Frame, error) {
+	return c.reader.ReadFrame()
 }
 
 func (c *CmdConn) Close(ctx context.Context) error {
@@ -1,5 +1,61 @@
 package protocol
 
-type Request struct {
-	Type byte
+import "fmt"
+
+// DataConnRequest asks the client for a new data connection. The client
+// echoes the RequestID in the ClientHello of that connection so the server can
+// pair it with the public connection waiting on it.
+//
+// Pooled connections are kept idle by the server until they are needed. The
+// client must not forward them until it reads an activate frame on them.
+//
+// Port is the forward the connection is for, it is only set once
+// CapabilityForwards has been negotiated.
+type DataConnRequest struct {
+	RequestID uint64
+	Pooled    bool
+	Port      uint16
+}
+
+const dataConnRequestPooled = 1 << 0
+
+func ParseDataConnRequestFrame(frame *Frame) (*DataConnRequest, error) {
+	d := decoder{buf: frame.Payload}
+	req := DataConnRequest{
+		RequestID: d.uint64(),
+	}
+	if !d.empty() {
+		req.Pooled = d.uint8()&dataConnRequestPooled != 0
+	}
+	if !d.empty() {
+		req.Port = d.uint16()
+	}
+	if frame.Type != TypeDataConnRequest || d.err != nil {
+		return nil, fmt.Errorf("Malformed data connection request")
+	}
+	return &req, nil
+}
+
+// ActivateFrame tells the client a pooled data connection is now in use.
+func ActivateFrame() Frame {
+	return Frame{Type: TypeDataConnActivate}
+}
+
+func (r DataConnRequest) Frame() Frame {
+	e := encoder{}
+	e.uint64(r.RequestID)
+	var flags uint8
+	if r.Pooled {
+		flags |= dataConnRequestPooled
+	}
+	if flags != 0 || r.Port != 0 {
+		e.uint8(flags)
+	}
+	if r.Port != 0 {
+		e.uint16(r.Port)
+	}
+	return Frame{
+		Type:    TypeDataConnRequest,
+		Payload: e.buf,
+	}
 }
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultUDPSessionTimeout is how long a UDP session may go without a
+// datagram in either direction before it is forgotten.
+const DefaultUDPSessionTimeout = time.Minute
+
+// MaxDatagramLength is the largest UDP payload that can be carried.
+const MaxDatagramLength = 65507
+
+// Datagram carries one UDP datagram over a UDP connection. Session tells the
+// client which of the server's public sources it came from, and the server
+// which of them a reply is for.
+type Datagram struct {
+	Session uint32
+	Data    []byte
+}
+
+func ParseDatagramFrame(frame *Frame) (*Datagram, error) {
+	d := decoder{buf: frame.Payload}
+	datagram := Datagram{
+		Session: d.uint32(),
+		Data:    d.rest(),
+	}
+	if frame.Type != TypeDatagram || d.err != nil {
+		return nil, fmt.Errorf("Malformed datagram")
+	}
+	return &datagram, nil
+}
+
+func (d Datagram) Frame() Frame {
+	e := encoder{}
+	e.uint32(d.Session)
+	e.raw(d.Data)
+	return Frame{
+		Type:    TypeDatagram,
+		Payload: e.buf,
+	}
+}
+
+// DatagramClose tells the client the server forgot an idle session.
+type DatagramClose struct {
+	Session uint32
+}
+
+func ParseDatagramCloseFrame(frame *Frame) (*DatagramClose, error) {
+	d := decoder{buf: frame.Payload}
+	close := DatagramClose{
+		Session: d.uint32(),
+	}
+	if frame.Type != TypeDatagramClose || d.err != nil {
+		return nil, fmt.Errorf("Malformed datagram close")
+	}
+	return &close, nil
+}
+
+func (c DatagramClose) Frame() Frame {
+	e := encoder{}
+	e.uint32(c.Session)
+	return Frame{
+		Type:    TypeDatagramClose,
+		Payload: e.buf,
+	}
+}
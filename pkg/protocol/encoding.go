@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// encoder and decoder build and consume big endian message payloads.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+// option writes a tag followed by the value prefixed by its length, values
+// are truncated to 255 bytes.
+func (e *encoder) option(tag uint8, v []byte) {
+	if len(v) > 0xff {
+		v = v[:0xff]
+	}
+	e.uint8(tag)
+	e.uint8(uint8(len(v)))
+	e.raw(v)
+}
+
+func (e *encoder) raw(v []byte) {
+	e.buf = append(e.buf, v...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = fmt.Errorf("Unexpected end of message")
+		return nil
+	}
+	ret := d.buf[:n]
+	d.buf = d.buf[n:]
+	return ret
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) empty() bool {
+	return d.err != nil || len(d.buf) == 0
+}
+
+func (d *decoder) rest() []byte {
+	if d.err != nil {
+		return nil
+	}
+	ret := d.buf
+	d.buf = nil
+	return ret
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Every message on the control protocol is a frame of the form
+// type (1 byte) | payload length (4 bytes, big endian) | payload
+const (
+	FrameHeaderLength     = 1 + 4
+	MaxFramePayloadLength = 64 * 1024
+)
+
+type Frame struct {
+	Type    byte
+	Payload []byte
+}
+
+func (f Frame) Serialize() []byte {
+	buf := make([]byte, FrameHeaderLength+len(f.Payload))
+	buf[0] = f.Type
+	binary.BigEndian.PutUint32(buf[1:FrameHeaderLength], uint32(len(f.Payload)))
+	copy(buf[FrameHeaderLength:], f.Payload)
+	return buf
+}
+
+// FrameReader reads whole frames from a stream. It never reads past the end of
+// a frame so the underlying reader can be handed off after a handshake.
+type FrameReader struct {
+	r      io.Reader
+	header [FrameHeaderLength]byte
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	_, err := io.ReadFull(fr.r, fr.header[:])
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(fr.header[1:])
+	if length > MaxFramePayloadLength {
+		return nil, fmt.Errorf("Frame payload too large %d", length)
+	}
+	frame := &Frame{
+		Type:    fr.header[0],
+		Payload: make([]byte, length),
+	}
+	_, err = io.ReadFull(fr.r, frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// FrameWriter writes whole frames to a stream and is safe for concurrent use.
+type FrameWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+func (fw *FrameWriter) WriteFrame(frame Frame) error {
+	if len(frame.Payload) > MaxFramePayloadLength {
+		return fmt.Errorf("Frame payload too large %d", len(frame.Payload))
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	_, err := fw.w.Write(frame.Serialize())
+	return err
+}
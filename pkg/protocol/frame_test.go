@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: TypeDataConnRequest, Payload: []byte{1, 2, 3}},
+		{Type: TypeServerHello, Payload: []byte{}},
+		{Type: ClientHelloTypeCommand, Payload: bytes.Repeat([]byte{7}, MaxFramePayloadLength)},
+	}
+	var stream bytes.Buffer
+	for _, frame := range frames {
+		stream.Write(frame.Serialize())
+	}
+	reader := NewFrameReader(&stream)
+	for _, want := range frames {
+		got, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("got type %d with %d bytes want type %d with %d bytes", got.Type, len(got.Payload), want.Type, len(want.Payload))
+		}
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Fatalf("read past the last frame %v", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	frame := Frame{Type: TypeDataConnRequest, Payload: make([]byte, MaxFramePayloadLength+1)}
+	_, err := NewFrameReader(bytes.NewReader(frame.Serialize())).ReadFrame()
+	if err == nil {
+		t.Fatal("read an oversized frame")
+	}
+}
+
+func TestFrameReaderStopsAtFrameEnd(t *testing.T) {
+	frame := Frame{Type: TypeDataConnRequest, Payload: []byte("abc")}
+	stream := bytes.NewReader(append(frame.Serialize(), "rest"...))
+	_, err := NewFrameReader(stream).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(stream)
+	if string(rest) != "rest" {
+		t.Fatalf("left %q", rest)
+	}
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// HealthReport is sent by the client whenever the health of its local service
+// changes, the server stops routing to it while it is unhealthy. Port is the
+// forward the report is for, zero for the only one.
+type HealthReport struct {
+	Port    uint16
+	Healthy bool
+	Reason  string
+}
+
+func ParseHealthReportFrame(frame *Frame) (*HealthReport, error) {
+	d := decoder{buf: frame.Payload}
+	report := HealthReport{
+		Healthy: d.uint8() != 0,
+		Reason:  string(d.next(int(d.uint8()))),
+	}
+	if !d.empty() {
+		report.Port = d.uint16()
+	}
+	if frame.Type != TypeHealthReport || d.err != nil {
+		return nil, fmt.Errorf("Malformed health report")
+	}
+	return &report, nil
+}
+
+func (r HealthReport) Frame() Frame {
+	e := encoder{}
+	if r.Healthy {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	// reasons are error messages, the start of a long one is enough
+	reason := r.Reason
+	if len(reason) > 0xff {
+		reason = reason[:0xff]
+	}
+	e.uint8(uint8(len(reason)))
+	e.raw([]byte(reason))
+	// the port is left out for a client's only forward so servers that
+	// predate it still understand the report
+	if r.Port != 0 {
+		e.uint16(r.Port)
+	}
+	return Frame{
+		Type:    TypeHealthReport,
+		Payload: e.buf,
+	}
+}
+
+func (r HealthReport) String() string {
+	if r.Healthy {
+		return "healthy"
+	}
+	return fmt.Sprintf("unhealthy (%s)", r.Reason)
+}
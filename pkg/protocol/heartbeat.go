@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeatInterval  = 10 * time.Second
+	DefaultHeartbeatMaxMissed = 3
+)
+
+// Heartbeat pings the peer on an interval and declares it dead once MaxMissed
+// pings in a row go unanswered. Each side of a command connection runs its own
+// heartbeat and answers the pings of the other.
+type Heartbeat struct {
+	Interval  time.Duration
+	MaxMissed int
+
+	lock     sync.Mutex
+	missed   int
+	rtt      time.Duration
+	lastPong time.Time
+}
+
+func NewHeartbeat(interval time.Duration, maxMissed int) *Heartbeat {
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if maxMissed <= 0 {
+		maxMissed = DefaultHeartbeatMaxMissed
+	}
+	return &Heartbeat{
+		Interval:  interval,
+		MaxMissed: maxMissed,
+	}
+}
+
+// Run sends pings until the context is done, a write fails or the peer is
+// declared dead.
+func (h *Heartbeat) Run(ctx context.Context, sender FrameSender) error {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		h.lock.Lock()
+		if h.missed >= h.MaxMissed {
+			missed := h.missed
+			h.lock.Unlock()
+			return fmt.Errorf("Peer missed %d heartbeats", missed)
+		}
+		h.missed++
+		h.lock.Unlock()
+
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		err := sender.WriteFrame(ctx, Frame{Type: TypePing, Payload: payload})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *Heartbeat) HandlePong(frame *Frame) error {
+	if len(frame.Payload) != 8 {
+		return fmt.Errorf("Malformed pong")
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(frame.Payload)))
+	now := time.Now()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.missed = 0
+	h.rtt = now.Sub(sent)
+	h.lastPong = now
+	return nil
+}
+
+func (h *Heartbeat) RTT() time.Duration {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.rtt
+}
+
+func (h *Heartbeat) LastPong() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastPong
+}
+
+// Pong returns the reply to a ping from the peer.
+func Pong(ping *Frame) Frame {
+	return Frame{Type: TypePong, Payload: ping.Payload}
+}
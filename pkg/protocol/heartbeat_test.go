@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ponger answers every ping until it is told to stop.
+type ponger struct {
+	lock      sync.Mutex
+	heartbeat *Heartbeat
+	answer    bool
+	pings     int
+}
+
+func (p *ponger) WriteFrame(ctx context.Context, frame Frame) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if frame.Type != TypePing {
+		return nil
+	}
+	p.pings++
+	if p.answer {
+		pong := Pong(&frame)
+		return p.heartbeat.HandlePong(&pong)
+	}
+	return nil
+}
+
+func TestHeartbeat(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		answer bool
+		dead   bool
+	}{
+		{name: "answered", answer: true, dead: false},
+		{name: "unanswered", answer: false, dead: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			heartbeat := NewHeartbeat(5*time.Millisecond, 3)
+			sender := &ponger{heartbeat: heartbeat, answer: c.answer}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := heartbeat.Run(ctx, sender)
+			if dead := err != nil && ctx.Err() == nil; dead != c.dead {
+				t.Fatalf("dead %v want %v %v", dead, c.dead, err)
+			}
+			if c.dead && sender.pings != heartbeat.MaxMissed {
+				t.Fatalf("sent %d pings before giving up want %d", sender.pings, heartbeat.MaxMissed)
+			}
+			if c.answer && heartbeat.LastPong().IsZero() {
+				t.Fatal("no pong recorded")
+			}
+		})
+	}
+}
+
+func TestHeartbeatDefaults(t *testing.T) {
+	heartbeat := NewHeartbeat(0, 0)
+	if heartbeat.Interval != DefaultHeartbeatInterval || heartbeat.MaxMissed != DefaultHeartbeatMaxMissed {
+		t.Fatalf("got %s %d", heartbeat.Interval, heartbeat.MaxMissed)
+	}
+}
+
+func TestHeartbeatPong(t *testing.T) {
+	heartbeat := NewHeartbeat(time.Second, 1)
+	heartbeat.missed = 1
+	sent := time.Now().Add(-50 * time.Millisecond)
+	payload := binary.BigEndian.AppendUint64(nil, uint64(sent.UnixNano()))
+	err := heartbeat.HandlePong(&Frame{Type: TypePong, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.missed != 0 || heartbeat.RTT() < 50*time.Millisecond {
+		t.Fatalf("missed %d rtt %s", heartbeat.missed, heartbeat.RTT())
+	}
+	if heartbeat.HandlePong(&Frame{Type: TypePong, Payload: []byte{1}}) == nil {
+		t.Fatal("handled a malformed pong")
+	}
+}
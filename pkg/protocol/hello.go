@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -14,88 +15,322 @@ const (
 const (
 	ClientHelloTypeCommand = 1
 	ClientHelloTypeData    = 2
+	// ClientHelloTypeDial asks the server to dial Destination and carry the
+	// connection to it, like ssh -L
+	ClientHelloTypeDial = 12
+	// ClientHelloTypeUDP asks the server to listen for UDP on Port and carry
+	// the datagrams over the connection
+	ClientHelloTypeUDP = 13
 
 	TypeServerHello = 3
+
+	TypeDataConnRequest = 4
+
+	TypePing = 5
+	TypePong = 6
+
+	TypeReject = 7
+
+	TypeChallenge         = 8
+	TypeChallengeResponse = 9
+
+	TypeHealthReport = 10
+
+	TypeDataConnActivate = 11
+
+	TypeDatagram      = 14
+	TypeDatagramClose = 15
+)
+
+// Stream frames carry multiplexed connections over the command connection and
+// are only sent once CapabilityMultiplex has been negotiated.
+const (
+	TypeStreamOpen   = 16
+	TypeStreamData   = 17
+	TypeStreamWindow = 18
+	TypeStreamClose  = 19
+	TypeStreamReset  = 20
 )
 
 type ClientHello struct {
-	Type   byte
-	ID     uint64
-	Port   uint16
-	Secret []byte
+	Type         byte
+	MinVersion   uint16
+	MaxVersion   uint16
+	Capabilities Capabilities
+	ID           uint64
+	RequestID    uint64
+	Port         uint16
+
+	// Options are only sent when set, so servers that predate them still
+	// understand hellos that do not use them
+	BindHost string
+	// LoadBalancing is the strategy the client asks for if it is the first
+	// on the port
+	LoadBalancing string
+	// Weight of the client for weighted load balancing
+	Weight uint16
+	// Priority of the client for failover, lower is preferred
+	Priority uint16
+	// ResumeToken resumes the session ID when reconnecting
+	ResumeToken []byte
+	// Forwards are the ports the client serves besides Port, servers only
+	// register them with CapabilityForwards
+	Forwards []Forward
+	// Destination is the host:port a dial hello asks the server to dial
+	Destination string
+}
+
+// Forward is one port a client serves and the options it registers it with.
+type Forward struct {
+	Port          uint16
+	BindHost      string
+	LoadBalancing string
+	Weight        uint16
+	Priority      uint16
+}
+
+// AllForwards returns the forward described by the hello's own fields
+// followed by its Forwards.
+func (c ClientHello) AllForwards() []Forward {
+	primary := Forward{
+		Port:          c.Port,
+		BindHost:      c.BindHost,
+		LoadBalancing: c.LoadBalancing,
+		Weight:        c.Weight,
+		Priority:      c.Priority,
+	}
+	return append([]Forward{primary}, c.Forwards...)
+}
+
+// Client hello options are encoded after the fixed fields as a tag, a length
+// and the value. Unknown tags are skipped.
+const (
+	helloOptionBindHost      = 1
+	helloOptionLoadBalancing = 2
+	helloOptionWeight        = 3
+	helloOptionPriority      = 4
+	helloOptionResumeToken   = 5
+	// helloOptionForward is repeated once for each additional forward
+	helloOptionForward     = 6
+	helloOptionDestination = 7
+)
+
+const ResumeTokenLength = 32
+
+func NewResumeToken() ([]byte, error) {
+	token := make([]byte, ResumeTokenLength)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
 }
 
 type ServerHello struct {
-	Type   byte
-	ID     uint64
-	Port   uint16
-	Secret []byte
+	Type         byte
+	Version      uint16
+	Capabilities Capabilities
+	ID           uint64
+	Port         uint16
+	// ResumeToken is only present when CapabilityResume was negotiated, and
+	// only set on command connections
+	ResumeToken []byte
+	// Ports are the ports registered for the client hello's Forwards in the
+	// same order, only present when CapabilityForwards was negotiated
+	Ports []uint16
+	Proof []byte
 }
 
 func ParseClientHello(conn net.Conn) (*ClientHello, error) {
-	buf := make([]byte, 1+8+2+MaxSecretLength)
-	n, err := conn.Read(buf)
+	frame, err := NewFrameReader(conn).ReadFrame()
 	if err != nil {
 		return nil, err
 	}
-	if n < MinSecretLength+1+8+2 {
-		return nil, fmt.Errorf("Malformed client hello")
+	return ParseClientHelloFrame(frame)
+}
+
+// ParseHelloVersions reads the version range that starts every client hello,
+// whatever the rest of its layout.
+func ParseHelloVersions(frame *Frame) (uint16, uint16, error) {
+	d := decoder{buf: frame.Payload}
+	minVersion, maxVersion := d.uint16(), d.uint16()
+	if d.err != nil {
+		return 0, 0, fmt.Errorf("Malformed client hello")
 	}
+	return minVersion, maxVersion, nil
+}
 
+func ParseClientHelloFrame(frame *Frame) (*ClientHello, error) {
+	d := decoder{buf: frame.Payload}
 	hello := ClientHello{
-		Type:   buf[0],
-		ID:     binary.BigEndian.Uint64(buf[1:9]),
-		Port:   binary.BigEndian.Uint16(buf[9:11]),
-		Secret: buf[11:n],
+		Type:         frame.Type,
+		MinVersion:   d.uint16(),
+		MaxVersion:   d.uint16(),
+		Capabilities: Capabilities(d.uint64()),
+		ID:           d.uint64(),
+		RequestID:    d.uint64(),
+		Port:         d.uint16(),
+	}
+	for !d.empty() {
+		tag := d.uint8()
+		value := decoder{buf: d.next(int(d.uint8()))}
+		switch tag {
+		case helloOptionBindHost:
+			hello.BindHost = string(value.rest())
+		case helloOptionLoadBalancing:
+			hello.LoadBalancing = string(value.rest())
+		case helloOptionWeight:
+			hello.Weight = value.uint16()
+		case helloOptionPriority:
+			hello.Priority = value.uint16()
+		case helloOptionResumeToken:
+			hello.ResumeToken = value.rest()
+		case helloOptionForward:
+			hello.Forwards = append(hello.Forwards, parseForward(&value))
+		case helloOptionDestination:
+			hello.Destination = string(value.rest())
+		}
+		if value.err != nil {
+			return nil, fmt.Errorf("Malformed client hello option %d", tag)
+		}
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("Malformed client hello")
 	}
 	return &hello, nil
 }
 
 func ParseServerHello(conn net.Conn) (*ServerHello, error) {
-	buf := make([]byte, 1+2+8+MaxSecretLength)
-	n, err := conn.Read(buf)
+	frame, err := NewFrameReader(conn).ReadFrame()
 	if err != nil {
 		return nil, err
 	}
-	if n < MinSecretLength+1+2+8 {
+	return ParseServerHelloFrame(frame)
+}
+
+// ParseServerHelloFrame returns the *RejectError sent by the server if it
+// refused the connection.
+func ParseServerHelloFrame(frame *Frame) (*ServerHello, error) {
+	if frame.Type == TypeReject {
+		reject, err := ParseRejectFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		return nil, reject
+	}
+	if frame.Type != TypeServerHello {
 		return nil, fmt.Errorf("Malformed server hello")
 	}
+	d := decoder{buf: frame.Payload}
 	hello := ServerHello{
-		Type:   buf[0],
-		ID:     binary.BigEndian.Uint64(buf[1 : 1+8]),
-		Port:   binary.BigEndian.Uint16(buf[1+8 : 1+8+2]),
-		Secret: buf[1+2+8 : n],
+		Type:         frame.Type,
+		Version:      d.uint16(),
+		Capabilities: Capabilities(d.uint64()),
+		ID:           d.uint64(),
+		Port:         d.uint16(),
+	}
+	if hello.Capabilities.Has(CapabilityResume) {
+		hello.ResumeToken = d.next(int(d.uint8()))
+	}
+	if hello.Capabilities.Has(CapabilityForwards) {
+		count := int(d.uint8())
+		for i := 0; i < count && d.err == nil; i++ {
+			hello.Ports = append(hello.Ports, d.uint16())
+		}
+	}
+	hello.Proof = d.rest()
+	// the proof is empty when the client authenticated by certificate alone
+	if d.err != nil || (len(hello.Proof) != 0 && len(hello.Proof) != ProofLength) {
+		return nil, fmt.Errorf("Malformed server hello")
 	}
 	return &hello, nil
 }
 
-func ParseServerHelloBytes(buf []byte) (*ServerHello, error) {
-	if len(buf) < MinSecretLength+1+2+8 {
-		return nil, fmt.Errorf("Malformed server hello")
+func (c ClientHello) Frame() Frame {
+	e := encoder{}
+	e.uint16(c.MinVersion)
+	e.uint16(c.MaxVersion)
+	e.uint64(uint64(c.Capabilities))
+	e.uint64(c.ID)
+	e.uint64(c.RequestID)
+	e.uint16(c.Port)
+	if len(c.BindHost) > 0 {
+		e.option(helloOptionBindHost, []byte(c.BindHost))
 	}
-	hello := ServerHello{
-		Type:   buf[0],
-		ID:     binary.BigEndian.Uint64(buf[1 : 1+8]),
-		Port:   binary.BigEndian.Uint16(buf[1+8 : 1+8+2]),
-		Secret: buf[1+2+8:],
+	if len(c.LoadBalancing) > 0 {
+		e.option(helloOptionLoadBalancing, []byte(c.LoadBalancing))
+	}
+	if c.Weight > 0 {
+		e.option(helloOptionWeight, binary.BigEndian.AppendUint16(nil, c.Weight))
+	}
+	if c.Priority > 0 {
+		e.option(helloOptionPriority, binary.BigEndian.AppendUint16(nil, c.Priority))
+	}
+	if len(c.ResumeToken) > 0 {
+		e.option(helloOptionResumeToken, c.ResumeToken)
+	}
+	for _, forward := range c.Forwards {
+		e.option(helloOptionForward, forward.encode())
+	}
+	if len(c.Destination) > 0 {
+		e.option(helloOptionDestination, []byte(c.Destination))
+	}
+	return Frame{
+		Type:    c.Type,
+		Payload: e.buf,
+	}
+}
+
+// encode writes the forward as an option value, the bind host is prefixed by
+// its length and the load balancing strategy is the rest.
+func (f Forward) encode() []byte {
+	e := encoder{}
+	e.uint16(f.Port)
+	e.uint16(f.Weight)
+	e.uint16(f.Priority)
+	e.uint8(uint8(len(f.BindHost)))
+	e.raw([]byte(f.BindHost))
+	e.raw([]byte(f.LoadBalancing))
+	return e.buf
+}
+
+func parseForward(d *decoder) Forward {
+	return Forward{
+		Port:          d.uint16(),
+		Weight:        d.uint16(),
+		Priority:      d.uint16(),
+		BindHost:      string(d.next(int(d.uint8()))),
+		LoadBalancing: string(d.rest()),
 	}
-	return &hello, nil
 }
 
 func (c ClientHello) Serialize() []byte {
-	ret := []byte{c.Type}
-	id := make([]byte, 8)
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint64(id, c.ID)
-	binary.BigEndian.PutUint16(port, c.Port)
-	return append(ret, append(id, append(port, c.Secret...)...)...)
+	return c.Frame().Serialize()
+}
+
+func (s ServerHello) Frame() Frame {
+	e := encoder{}
+	e.uint16(s.Version)
+	e.uint64(uint64(s.Capabilities))
+	e.uint64(s.ID)
+	e.uint16(s.Port)
+	if s.Capabilities.Has(CapabilityResume) {
+		e.uint8(uint8(len(s.ResumeToken)))
+		e.raw(s.ResumeToken)
+	}
+	if s.Capabilities.Has(CapabilityForwards) {
+		e.uint8(uint8(len(s.Ports)))
+		for _, port := range s.Ports {
+			e.uint16(port)
+		}
+	}
+	e.raw(s.Proof)
+	return Frame{
+		Type:    s.Type,
+		Payload: e.buf,
+	}
 }
 
 func (s ServerHello) Serialize() []byte {
-	ret := []byte{s.Type}
-	id := make([]byte, 8)
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint64(id, s.ID)
-	binary.BigEndian.PutUint16(port, s.Port)
-	return append(ret, append(id, append(port, s.Secret...)...)...)
+	return s.Frame().Serialize()
 }
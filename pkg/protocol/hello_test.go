@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientHelloRoundTrip(t *testing.T) {
+	hello := ClientHello{
+		Type:          ClientHelloTypeCommand,
+		MinVersion:    MinProtocolVersion,
+		MaxVersion:    ProtocolVersion,
+		Capabilities:  SupportedCapabilities,
+		ID:            42,
+		RequestID:     7,
+		Port:          8080,
+		BindHost:      "::1",
+		LoadBalancing: "weighted",
+		Weight:        3,
+		Priority:      2,
+		ResumeToken:   bytes.Repeat([]byte{9}, ResumeTokenLength),
+		Forwards: []Forward{
+			{Port: 8081, BindHost: "127.0.0.1", LoadBalancing: "least-conns", Weight: 2, Priority: 1},
+			{},
+		},
+	}
+	frame := hello.Frame()
+	parsed, err := ParseClientHelloFrame(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*parsed, hello) {
+		t.Fatalf("got %+v want %+v", *parsed, hello)
+	}
+	minVersion, maxVersion, err := ParseHelloVersions(&frame)
+	if err != nil || minVersion != hello.MinVersion || maxVersion != hello.MaxVersion {
+		t.Fatalf("versions %d-%d %v", minVersion, maxVersion, err)
+	}
+}
+
+func TestDialHelloRoundTrip(t *testing.T) {
+	hello := ClientHello{
+		Type:        ClientHelloTypeDial,
+		MinVersion:  MinProtocolVersion,
+		MaxVersion:  ProtocolVersion,
+		Destination: "db.internal:5432",
+	}
+	frame := hello.Frame()
+	parsed, err := ParseClientHelloFrame(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*parsed, hello) {
+		t.Fatalf("got %+v want %+v", *parsed, hello)
+	}
+}
+
+func TestClientHelloWithoutOptions(t *testing.T) {
+	hello := ClientHello{Type: ClientHelloTypeData, MinVersion: 1, MaxVersion: 2, ID: 1, RequestID: 2, Port: 3}
+	frame := hello.Frame()
+	parsed, err := ParseClientHelloFrame(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*parsed, hello) {
+		t.Fatalf("got %+v want %+v", *parsed, hello)
+	}
+}
+
+func TestClientHelloSkipsUnknownOptions(t *testing.T) {
+	hello := ClientHello{Type: ClientHelloTypeCommand, MinVersion: 1, MaxVersion: 2, Port: 3, BindHost: "localhost"}
+	frame := hello.Frame()
+	frame.Payload = append(frame.Payload, 200, 2, 0xab, 0xcd)
+	parsed, err := ParseClientHelloFrame(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.BindHost != "localhost" || parsed.Port != 3 {
+		t.Fatalf("got %+v", *parsed)
+	}
+}
+
+func TestClientHelloMalformed(t *testing.T) {
+	hello := ClientHello{Type: ClientHelloTypeCommand, MinVersion: 1, MaxVersion: 2, BindHost: "localhost"}
+	frame := hello.Frame()
+	for _, n := range []int{0, 3, 10, len(frame.Payload) - 1} {
+		truncated := Frame{Type: frame.Type, Payload: frame.Payload[:n]}
+		if _, err := ParseClientHelloFrame(&truncated); err == nil {
+			t.Fatalf("parsed a hello truncated to %d bytes", n)
+		}
+	}
+	if _, _, err := ParseHelloVersions(&Frame{Payload: []byte{0, 1, 0}}); err == nil {
+		t.Fatal("parsed versions from 3 bytes")
+	}
+}
+
+func TestServerHelloRoundTrip(t *testing.T) {
+	proof := bytes.Repeat([]byte{1}, ProofLength)
+	for _, c := range []struct {
+		name  string
+		hello ServerHello
+	}{
+		{name: "plain", hello: ServerHello{Type: TypeServerHello, Version: 2, ID: 1, Port: 2, Proof: proof}},
+		{name: "certificate only", hello: ServerHello{Type: TypeServerHello, Version: 2, ID: 1, Port: 2, Proof: []byte{}}},
+		{name: "resume token", hello: ServerHello{Type: TypeServerHello, Version: 2, Capabilities: CapabilityResume, ID: 1, ResumeToken: bytes.Repeat([]byte{2}, ResumeTokenLength), Proof: proof}},
+		{name: "resume without token", hello: ServerHello{Type: TypeServerHello, Version: 2, Capabilities: CapabilityResume, ID: 1, ResumeToken: []byte{}, Proof: proof}},
+		{name: "forward ports", hello: ServerHello{Type: TypeServerHello, Version: 2, Capabilities: CapabilityForwards, ID: 1, Port: 2, Ports: []uint16{3, 4}, Proof: proof}},
+		{name: "resume and forward ports", hello: ServerHello{Type: TypeServerHello, Version: 2, Capabilities: CapabilityResume | CapabilityForwards, ID: 1, ResumeToken: bytes.Repeat([]byte{2}, ResumeTokenLength), Ports: []uint16{3}, Proof: proof}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			frame := c.hello.Frame()
+			parsed, err := ParseServerHelloFrame(&frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*parsed, c.hello) {
+				t.Fatalf("got %+v want %+v", *parsed, c.hello)
+			}
+			frame.Type = ClientHelloTypeCommand
+			if _, err := ParseServerHelloFrame(&frame); err == nil {
+				t.Fatal("parsed a server hello with the wrong type")
+			}
+		})
+	}
+}
+
+func TestServerHelloBadProof(t *testing.T) {
+	hello := ServerHello{Type: TypeServerHello, Version: 2, Proof: []byte{1, 2, 3}}
+	frame := hello.Frame()
+	if _, err := ParseServerHelloFrame(&frame); err == nil {
+		t.Fatal("parsed a short proof")
+	}
+}
+
+func TestServerHelloReject(t *testing.T) {
+	frame := Reject(RejectCodeUnsupportedVersion, "version %d", 1).Frame()
+	_, err := ParseServerHelloFrame(&frame)
+	var reject *RejectError
+	if !errors.As(err, &reject) || reject.Code != RejectCodeUnsupportedVersion || reject.Reason != "version 1" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, c := range []struct {
+		localMin, localMax, remoteMin, remoteMax uint16
+		version                                  uint16
+		ok                                       bool
+	}{
+		{1, 2, 1, 2, 2, true},
+		{1, 3, 2, 2, 2, true},
+		{2, 3, 1, 5, 3, true},
+		{2, 3, 1, 1, 0, false},
+		{2, 3, 4, 5, 0, false},
+		{1, 3, 3, 2, 0, false},
+	} {
+		version, err := NegotiateVersion(c.localMin, c.localMax, c.remoteMin, c.remoteMax)
+		if (err == nil) != c.ok || version != c.version {
+			t.Fatalf("%+v got %d %v", c, version, err)
+		}
+	}
+}
+
+func TestVersionOneIsRetired(t *testing.T) {
+	if _, err := NegotiateVersion(MinProtocolVersion, ProtocolVersion, 1, 1); err == nil {
+		t.Fatal("negotiated version 1")
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	var frame Frame
+	for _, req := range []DataConnRequest{{RequestID: 1}, {RequestID: 2, Pooled: true}, {RequestID: 3, Port: 8080}, {RequestID: 4, Pooled: true, Port: 8080}} {
+		frame = req.Frame()
+		parsed, err := ParseDataConnRequestFrame(&frame)
+		if err != nil || *parsed != req {
+			t.Fatalf("got %+v %v want %+v", parsed, err, req)
+		}
+	}
+	for _, report := range []HealthReport{{Healthy: true}, {Healthy: false, Reason: "connection refused"}, {Port: 8080, Healthy: true}} {
+		frame = report.Frame()
+		parsedReport, err := ParseHealthReportFrame(&frame)
+		if err != nil || *parsedReport != report {
+			t.Fatalf("got %+v %v want %+v", parsedReport, err, report)
+		}
+	}
+	for _, datagram := range []Datagram{{Session: 1, Data: []byte{}}, {Session: 2, Data: []byte("payload")}} {
+		frame = datagram.Frame()
+		parsedDatagram, err := ParseDatagramFrame(&frame)
+		if err != nil || !reflect.DeepEqual(*parsedDatagram, datagram) {
+			t.Fatalf("got %+v %v want %+v", parsedDatagram, err, datagram)
+		}
+	}
+	frame = DatagramClose{Session: 3}.Frame()
+	parsedClose, err := ParseDatagramCloseFrame(&frame)
+	if err != nil || parsedClose.Session != 3 {
+		t.Fatalf("got %+v %v", parsedClose, err)
+	}
+	frame = HealthReport{Reason: strings.Repeat("x", 300)}.Frame()
+	parsedReport, err := ParseHealthReportFrame(&frame)
+	if err != nil || len(parsedReport.Reason) != 0xff {
+		t.Fatalf("got %+v %v", parsedReport, err)
+	}
+}
@@ -0,0 +1,104 @@
+package protocol
+
+import "fmt"
+
+type RejectCode uint16
+
+const (
+	RejectCodeUnknown              RejectCode = 0
+	RejectCodeMalformedHello       RejectCode = 1
+	RejectCodeAuthenticationFailed RejectCode = 2
+	RejectCodeUnsupportedVersion   RejectCode = 3
+	RejectCodeBackendOwnerMismatch RejectCode = 4
+	RejectCodeNoBackend            RejectCode = 5
+	RejectCodeNoTarget             RejectCode = 6
+	RejectCodeNoPendingRequest     RejectCode = 7
+	RejectCodeUnauthorized         RejectCode = 8
+	RejectCodePortNotAllowed       RejectCode = 9
+	RejectCodeBackendLimit         RejectCode = 10
+	RejectCodeNoPortAvailable      RejectCode = 11
+	RejectCodeBindNotAllowed       RejectCode = 12
+	RejectCodePortInUse            RejectCode = 13
+	RejectCodeResumeFailed         RejectCode = 14
+	RejectCodeDestinationDenied    RejectCode = 15
+	RejectCodeDialFailed           RejectCode = 16
+)
+
+func (c RejectCode) String() string {
+	switch c {
+	case RejectCodeMalformedHello:
+		return "malformed hello"
+	case RejectCodeAuthenticationFailed:
+		return "authentication failed"
+	case RejectCodeUnsupportedVersion:
+		return "unsupported version"
+	case RejectCodeBackendOwnerMismatch:
+		return "backend owner mismatch"
+	case RejectCodeNoBackend:
+		return "no backend"
+	case RejectCodeNoTarget:
+		return "no target"
+	case RejectCodeNoPendingRequest:
+		return "no pending request"
+	case RejectCodeUnauthorized:
+		return "unauthorized"
+	case RejectCodePortNotAllowed:
+		return "port not allowed"
+	case RejectCodeBackendLimit:
+		return "backend limit reached"
+	case RejectCodeNoPortAvailable:
+		return "no port available"
+	case RejectCodeBindNotAllowed:
+		return "bind not allowed"
+	case RejectCodePortInUse:
+		return "port in use"
+	case RejectCodeResumeFailed:
+		return "resume failed"
+	case RejectCodeDestinationDenied:
+		return "destination denied"
+	case RejectCodeDialFailed:
+		return "dial failed"
+	default:
+		return "unknown"
+	}
+}
+
+// RejectError is sent by the server in place of a ServerHello when it refuses
+// a connection, and surfaced on the client as the handshake error.
+type RejectError struct {
+	Code   RejectCode
+	Reason string
+}
+
+func Reject(code RejectCode, format string, args ...interface{}) *RejectError {
+	return &RejectError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("Connection rejected (%s): %s", e.Code, e.Reason)
+}
+
+func ParseRejectFrame(frame *Frame) (*RejectError, error) {
+	d := decoder{buf: frame.Payload}
+	reject := RejectError{
+		Code:   RejectCode(d.uint16()),
+		Reason: string(d.rest()),
+	}
+	if frame.Type != TypeReject || d.err != nil {
+		return nil, fmt.Errorf("Malformed reject")
+	}
+	return &reject, nil
+}
+
+func (e *RejectError) Frame() Frame {
+	enc := encoder{}
+	enc.uint16(uint16(e.Code))
+	enc.raw([]byte(e.Reason))
+	return Frame{
+		Type:    TypeReject,
+		Payload: enc.buf,
+	}
+}
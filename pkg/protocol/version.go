@@ -0,0 +1,54 @@
+package protocol
+
+import "fmt"
+
+// Protocol versions this build can speak. Bump ProtocolVersion for every wire
+// format change and raise MinProtocolVersion once older peers are retired.
+const (
+	MinProtocolVersion uint16 = 3
+	ProtocolVersion    uint16 = 10
+)
+
+// Capabilities is a bitmap of optional protocol features. Each side
+// advertises what it supports and the server replies with the intersection.
+type Capabilities uint64
+
+const (
+	CapabilityMultiplex Capabilities = 1 << 0
+	CapabilityHeartbeat Capabilities = 1 << 1
+	// CapabilityHealthCheck means the client reports the health of its local
+	// service
+	CapabilityHealthCheck Capabilities = 1 << 2
+	// CapabilityConnPool means the server may ask for idle data connections
+	// ahead of time and activates them when they are used
+	CapabilityConnPool Capabilities = 1 << 3
+	// CapabilityResume means the server hands out resume tokens and keeps a
+	// disconnected client's place until it reconnects with one
+	CapabilityResume Capabilities = 1 << 4
+	// CapabilityForwards means the server registers every forward in the
+	// client hello and routes data connections, streams and health reports
+	// by port
+	CapabilityForwards Capabilities = 1 << 5
+
+	SupportedCapabilities = CapabilityMultiplex | CapabilityHeartbeat | CapabilityHealthCheck | CapabilityConnPool | CapabilityResume | CapabilityForwards
+)
+
+func (c Capabilities) Has(capability Capabilities) bool {
+	return c&capability == capability
+}
+
+// NegotiateVersion returns the highest version in both the local and remote
+// ranges.
+func NegotiateVersion(localMin, localMax, remoteMin, remoteMax uint16) (uint16, error) {
+	if remoteMin > remoteMax {
+		return 0, fmt.Errorf("Invalid protocol version range %d-%d", remoteMin, remoteMax)
+	}
+	version := localMax
+	if remoteMax < version {
+		version = remoteMax
+	}
+	if version < localMin || version < remoteMin {
+		return 0, fmt.Errorf("No common protocol version, peer supports %d-%d and we support %d-%d", remoteMin, remoteMax, localMin, localMax)
+	}
+	return version, nil
+}
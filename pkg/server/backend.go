@@ -3,7 +3,9 @@ package server
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 	"github.com/mat285/tcptunnel/pkg/tcp"
@@ -12,10 +14,14 @@ import (
 type Backend struct {
 	*tcp.Server
 
-	secret []byte
+	owner    string
+	Strategy Strategy
+	balancer Balancer
 
 	lock    sync.Mutex
 	running bool
+	stopped bool
+	cancel  context.CancelFunc
 
 	targets        map[uint64]*Target
 	addedDataConns chan idConn
@@ -26,13 +32,15 @@ type idConn struct {
 	conn tcp.Conn
 }
 
-func NewBackend(port uint16, secret []byte) *Backend {
+func NewBackend(host string, port uint16, owner string, strategy Strategy) *Backend {
 	backend := &Backend{
 		targets:        make(map[uint64]*Target),
-		secret:         secret,
+		owner:          owner,
+		Strategy:       strategy,
+		balancer:       NewBalancer(strategy),
 		addedDataConns: make(chan idConn, 16),
 	}
-	backend.Server = tcp.NewServer(port, backend.NextConn)
+	backend.Server = tcp.NewServer(host, port, backend.NextConn)
 	return backend
 }
 
@@ -42,29 +50,69 @@ func (b *Backend) AddTarget(ctx context.Context, target *Target) {
 	b.targets[target.ID] = target
 }
 
+// RemoveTarget removes the target from the backend and returns the number of
+// targets left.
+func (b *Backend) RemoveTarget(ctx context.Context, target *Target) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.targets[target.ID] == target {
+		delete(b.targets, target.ID)
+	}
+	return len(b.targets)
+}
+
+func (b *Backend) TargetCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.targets)
+}
+
 func (b *Backend) Run(ctx context.Context) error {
+	b.lock.Lock()
 	if b.running {
+		b.lock.Unlock()
 		return fmt.Errorf("already running backend")
 	}
-	b.lock.Lock()
+	if b.stopped {
+		b.lock.Unlock()
+		return nil
+	}
 	b.running = true
+	ctx, cancel := context.WithCancel(ctx)
+	b.cancel = cancel
 	b.lock.Unlock()
+	defer cancel()
 
 	return b.runRestartServer(ctx)
 }
 
+// Stop closes the listener and every tunnel through the backend, it cannot be
+// restarted afterwards.
+func (b *Backend) Stop() {
+	b.lock.Lock()
+	b.stopped = true
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.lock.Unlock()
+	// releases the port if it was bound but never served
+	b.Server.Stop()
+}
+
 func (b *Backend) runRestartServer(ctx context.Context) error {
 	log := logger.GetLogger(ctx)
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
 		err := b.Server.Listen(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
 			logger.MaybeErrorfContext(ctx, log, "Error running server %s", err.Error())
-			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
 		}
 	}
 }
@@ -72,9 +120,18 @@ func (b *Backend) runRestartServer(ctx context.Context) error {
 func (b *Backend) NextConn(ctx context.Context) (tcp.Conn, error) {
 	log := logger.GetLogger(ctx)
 	b.lock.Lock()
-	defer b.lock.Unlock()
-
+	targets := make([]*Target, 0, len(b.targets))
 	for _, target := range b.targets {
+		targets = append(targets, target)
+	}
+	b.lock.Unlock()
+	targets = availableTargets(targets)
+	// map order is random, balancers need a stable order to work from
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].ID < targets[j].ID
+	})
+
+	for _, target := range b.balancer.Order(ctx, targets) {
 		logger.MaybeDebugfContext(ctx, log, "Requesting connection from %d", target.ID)
 		conn, err := target.GetConn(ctx)
 		if err != nil {
@@ -87,14 +144,20 @@ func (b *Backend) NextConn(ctx context.Context) (tcp.Conn, error) {
 	return nil, fmt.Errorf("No available connections")
 }
 
-func (b *Backend) ValidSecret(secret []byte) bool {
-	if len(secret) != len(b.secret) {
-		return false
-	}
-	for i := 0; i < len(secret); i++ {
-		if secret[i] != b.secret[i] {
-			return false
+// availableTargets drops unhealthy targets and closed ones waiting to be
+// resumed.
+func availableTargets(targets []*Target) []*Target {
+	available := targets[:0]
+	for _, target := range targets {
+		if target.Healthy() && target.State() != TargetStateClosed {
+			available = append(available, target)
 		}
 	}
-	return true
+	return available
+}
+
+// OwnedBy reports whether the identity may add targets to the backend, only
+// the identity that created it may.
+func (b *Backend) OwnedBy(identity *Identity) bool {
+	return b.owner == identity.Name
 }
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+// Strategy picks which target of a backend serves each public connection.
+type Strategy string
+
+const (
+	StrategyRoundRobin Strategy = "round-robin"
+	StrategyLeastConns Strategy = "least-conns"
+	StrategyRandom     Strategy = "random"
+	// StrategyWeighted picks targets at random in proportion to the weight
+	// each client registered with
+	StrategyWeighted Strategy = "weighted"
+	// StrategyFailover prefers the target with the lowest priority and only
+	// uses the others when it fails
+	StrategyFailover Strategy = "failover"
+	// StrategySourceIP consistently hashes the public client's IP onto the
+	// targets so it keeps landing on the same one, when a target leaves only
+	// the clients it served move
+	StrategySourceIP Strategy = "source-ip"
+
+	DefaultStrategy = StrategyRoundRobin
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch strategy := Strategy(s); strategy {
+	case StrategyRoundRobin, StrategyLeastConns, StrategyRandom, StrategyWeighted, StrategyFailover, StrategySourceIP:
+		return strategy, nil
+	case "":
+		return DefaultStrategy, nil
+	default:
+		return "", fmt.Errorf("Unknown load balancing strategy %s", s)
+	}
+}
+
+// Balancer orders the targets of a backend by preference for a new public
+// connection, whose metadata is in the context. Targets after the first are
+// tried in turn if it fails.
+type Balancer interface {
+	Order(ctx context.Context, targets []*Target) []*Target
+}
+
+func NewBalancer(strategy Strategy) Balancer {
+	switch strategy {
+	case StrategyLeastConns:
+		return leastConnsBalancer{}
+	case StrategyRandom:
+		return randomBalancer{}
+	case StrategyWeighted:
+		return weightedBalancer{}
+	case StrategyFailover:
+		return failoverBalancer{}
+	case StrategySourceIP:
+		return &hashBalancer{}
+	default:
+		return &roundRobinBalancer{}
+	}
+}
+
+type roundRobinBalancer struct {
+	lock sync.Mutex
+	next int
+}
+
+func (b *roundRobinBalancer) Order(_ context.Context, targets []*Target) []*Target {
+	if len(targets) == 0 {
+		return targets
+	}
+	b.lock.Lock()
+	start := b.next % len(targets)
+	b.next = start + 1
+	b.lock.Unlock()
+	ordered := make([]*Target, 0, len(targets))
+	ordered = append(ordered, targets[start:]...)
+	return append(ordered, targets[:start]...)
+}
+
+type leastConnsBalancer struct{}
+
+func (leastConnsBalancer) Order(_ context.Context, targets []*Target) []*Target {
+	active := make(map[*Target]int64, len(targets))
+	for _, target := range targets {
+		active[target] = target.ActiveConns()
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return active[targets[i]] < active[targets[j]]
+	})
+	return targets
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Order(_ context.Context, targets []*Target) []*Target {
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	return targets
+}
+
+type weightedBalancer struct{}
+
+// Order draws targets one at a time without replacement, each with a chance
+// proportional to its weight.
+func (weightedBalancer) Order(_ context.Context, targets []*Target) []*Target {
+	ordered := make([]*Target, 0, len(targets))
+	remaining := append([]*Target(nil), targets...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, target := range remaining {
+			total += target.weight()
+		}
+		pick := rand.Intn(total)
+		for i, target := range remaining {
+			pick -= target.weight()
+			if pick < 0 {
+				ordered = append(ordered, target)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+type failoverBalancer struct{}
+
+func (failoverBalancer) Order(_ context.Context, targets []*Target) []*Target {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Priority < targets[j].Priority
+	})
+	return targets
+}
+
+// hashReplicas is how many points each target has on the hash ring, more
+// spread clients more evenly.
+const hashReplicas = 128
+
+type hashPoint struct {
+	hash   uint64
+	target *Target
+}
+
+type hashBalancer struct {
+	lock    sync.Mutex
+	targets []*Target
+	ring    []hashPoint
+}
+
+// Order walks the ring from the client's point, so the targets after the
+// first are the ones its clients would move to if it left.
+func (b *hashBalancer) Order(ctx context.Context, targets []*Target) []*Target {
+	meta := tcp.GetConnMeta(ctx)
+	if meta == nil || meta.RemoteAddr == nil || len(targets) == 0 {
+		return targets
+	}
+	ring := b.getRing(targets)
+	key := hashString(sourceIP(meta.RemoteAddr))
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= key
+	})
+
+	ordered := make([]*Target, 0, len(targets))
+	seen := make(map[*Target]bool, len(targets))
+	for i := 0; i < len(ring) && len(ordered) < len(targets); i++ {
+		target := ring[(start+i)%len(ring)].target
+		if !seen[target] {
+			seen[target] = true
+			ordered = append(ordered, target)
+		}
+	}
+	return ordered
+}
+
+// getRing returns the ring for the targets, rebuilding it only when they
+// change. Targets are compared by pointer, so a target replaced by another
+// with the same ID still rebuilds it, and placed on the ring by ID.
+func (b *hashBalancer) getRing(targets []*Target) []hashPoint {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.sameTargets(targets) {
+		return b.ring
+	}
+	ring := make([]hashPoint, 0, len(targets)*hashReplicas)
+	for _, target := range targets {
+		for i := 0; i < hashReplicas; i++ {
+			ring = append(ring, hashPoint{
+				hash:   hashString(fmt.Sprintf("%d-%d", target.ID, i)),
+				target: target,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	b.targets, b.ring = append([]*Target(nil), targets...), ring
+	return ring
+}
+
+func (b *hashBalancer) sameTargets(targets []*Target) bool {
+	if len(targets) != len(b.targets) {
+		return false
+	}
+	for i, target := range targets {
+		if b.targets[i] != target || b.ring == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func sourceIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// hashString spreads similar strings such as neighbouring IPs over the whole
+// ring, FNV alone leaves their high bits close together.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
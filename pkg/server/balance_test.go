@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+func newTargets(n int) []*Target {
+	targets := make([]*Target, n)
+	for i := range targets {
+		targets[i] = &Target{ID: uint64(i + 1)}
+	}
+	return targets
+}
+
+func fromIP(ip string) context.Context {
+	return tcp.WithConnMeta(context.Background(), tcp.ConnMeta{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000},
+	})
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		strategy Strategy
+		ok       bool
+	}{
+		{name: "", strategy: DefaultStrategy, ok: true},
+		{name: "least-conns", strategy: StrategyLeastConns, ok: true},
+		{name: "failover", strategy: StrategyFailover, ok: true},
+		{name: "source-ip", strategy: StrategySourceIP, ok: true},
+		{name: "fastest", ok: false},
+	} {
+		strategy, err := ParseStrategy(c.name)
+		if (err == nil) != c.ok || strategy != c.strategy {
+			t.Fatalf("%q got %s %v", c.name, strategy, err)
+		}
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	targets := newTargets(3)
+	balancer := NewBalancer(StrategyRoundRobin)
+	for i := 0; i < 6; i++ {
+		ordered := balancer.Order(context.Background(), targets)
+		if len(ordered) != 3 || ordered[0] != targets[i%3] || ordered[1] != targets[(i+1)%3] {
+			t.Fatalf("round %d started at %d", i, ordered[0].ID)
+		}
+	}
+}
+
+func TestLeastConnsBalancer(t *testing.T) {
+	targets := newTargets(3)
+	targets[0].active, targets[1].active, targets[2].active = 5, 0, 2
+	ordered := NewBalancer(StrategyLeastConns).Order(context.Background(), targets)
+	if ordered[0].ID != 2 || ordered[1].ID != 3 || ordered[2].ID != 1 {
+		t.Fatalf("got order %d %d %d", ordered[0].ID, ordered[1].ID, ordered[2].ID)
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	targets := newTargets(2)
+	targets[0].Weight, targets[1].Weight = 9, 1
+	balancer := NewBalancer(StrategyWeighted)
+	first := 0
+	for i := 0; i < 1000; i++ {
+		ordered := balancer.Order(context.Background(), targets)
+		if len(ordered) != 2 || ordered[0] == ordered[1] {
+			t.Fatal("targets dropped or repeated")
+		}
+		if ordered[0] == targets[0] {
+			first++
+		}
+	}
+	if first < 800 || first > 970 {
+		t.Fatalf("heavier target first %d of 1000 times", first)
+	}
+}
+
+func TestFailoverBalancer(t *testing.T) {
+	targets := newTargets(3)
+	targets[0].Priority, targets[1].Priority, targets[2].Priority = 2, 0, 1
+	ordered := NewBalancer(StrategyFailover).Order(context.Background(), targets)
+	if ordered[0].ID != 2 || ordered[1].ID != 3 || ordered[2].ID != 1 {
+		t.Fatalf("got order %d %d %d", ordered[0].ID, ordered[1].ID, ordered[2].ID)
+	}
+}
+
+func TestHashBalancerIsSticky(t *testing.T) {
+	targets := newTargets(4)
+	balancer := NewBalancer(StrategySourceIP)
+	used := make(map[*Target]bool)
+	for i := 0; i < 64; i++ {
+		ctx := fromIP(fmt.Sprintf("10.0.0.%d", i))
+		first := balancer.Order(ctx, targets)[0]
+		used[first] = true
+		for j := 0; j < 3; j++ {
+			if balancer.Order(ctx, targets)[0] != first {
+				t.Fatalf("10.0.0.%d moved between targets", i)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("64 clients landed on %d targets", len(used))
+	}
+}
+
+func TestHashBalancerOnlyMovesLostClients(t *testing.T) {
+	targets := newTargets(4)
+	balancer := NewBalancer(StrategySourceIP)
+	before := make(map[string]*Target)
+	for i := 0; i < 64; i++ {
+		ip := fmt.Sprintf("10.0.1.%d", i)
+		before[ip] = balancer.Order(fromIP(ip), targets)[0]
+	}
+	remaining := []*Target{targets[0], targets[1], targets[3]}
+	for ip, target := range before {
+		ordered := balancer.Order(fromIP(ip), remaining)
+		if len(ordered) != 3 {
+			t.Fatalf("ordered %d targets", len(ordered))
+		}
+		if target != targets[2] && ordered[0] != target {
+			t.Fatalf("%s moved from target %d to %d", ip, target.ID, ordered[0].ID)
+		}
+	}
+}
+
+func TestHashBalancerFollowsReplacedTargets(t *testing.T) {
+	targets := newTargets(3)
+	balancer := NewBalancer(StrategySourceIP)
+	ctx := fromIP("10.0.2.1")
+	first := balancer.Order(ctx, targets)[0]
+
+	// the target is replaced by a new one with the same ID
+	replaced := append([]*Target(nil), targets...)
+	for i, target := range replaced {
+		if target == first {
+			replaced[i] = &Target{ID: target.ID}
+		}
+	}
+	ordered := balancer.Order(ctx, replaced)
+	if ordered[0] == first || ordered[0].ID != first.ID {
+		t.Fatalf("got target %d (stale %v) want the replacement %d", ordered[0].ID, ordered[0] == first, first.ID)
+	}
+}
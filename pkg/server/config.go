@@ -1,20 +1,180 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/blend/go-sdk/configutil"
 	"github.com/blend/go-sdk/logger"
 	"github.com/mat285/tcptunnel/pkg/config"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+const (
+	DefaultClientConnectTimeout = 10 * time.Second
+	DefaultDialTimeout          = 10 * time.Second
 )
 
 type Config struct {
-	Port uint16
+	// BindHost is the address the control port listens on, every interface
+	// if empty
+	BindHost string
+	Port     uint16
+	// BackendBindHost is the address backends listen on unless a client asks
+	// for one its policy allows, every interface if empty
+	BackendBindHost string
+	// LoadBalancing is the strategy for new backends, unless the first client
+	// for the port asks for another
+	LoadBalancing Strategy
 
 	ClientConnectTimeout time.Duration
 
+	DisableMultiplex bool
+
+	HeartbeatInterval  time.Duration
+	HeartbeatMaxMissed int
+
+	// DataConnPoolMinIdle and DataConnPoolMaxIdle bound how many idle data
+	// connections each non multiplexed target keeps ready, pooling is off if
+	// the maximum is zero
+	DataConnPoolMinIdle int
+	DataConnPoolMaxIdle int
+
+	// BackendGracePeriod keeps a backend listening after its last target
+	// disconnects so the client can reconnect without losing the port
+	BackendGracePeriod time.Duration
+	// ResumeWindow keeps a disconnected target in its backend so the client
+	// can reconnect under the same ID with its resume token, resumption is
+	// off if it is zero
+	ResumeWindow time.Duration
+
+	// Secret is shared by all clients not covered by Secrets
 	Secret []byte
+	// SecretPolicy limits clients authenticated by Secret, they may claim
+	// any port on the default bind address if it is empty
+	SecretPolicy Policy
+	// AssignPorts is the range ports are allocated from for clients that
+	// ask for port 0, such requests are rejected if it is not set
+	AssignPorts PortRange
+	// Secrets give each client its own secret and policy
+	Secrets []SecretPolicy
+
+	TLS TLSConfig
+
+	// Identities authorizes client certificates, clients presenting a
+	// certificate that matches none of them are rejected
+	Identities []IdentityPolicy
+
+	// Destinations are what local forwarding and SOCKS clients may ask the
+	// server to dial, in the format of tcp.AddressList. Nothing is dialed if
+	// empty. DeniedDestinations are never dialed.
+	Destinations       []string
+	DeniedDestinations []string
+	DialTimeout        time.Duration
+
+	// UDPSessionTimeout is how long a UDP source address may be silent
+	// before its session is forgotten, protocol.DefaultUDPSessionTimeout if
+	// zero
+	UDPSessionTimeout time.Duration
+	// UDPMaxSessions caps the sessions each UDP port tracks at once,
+	// unlimited if zero. UDPSessionOverflow decides what happens to a new
+	// source past the cap, drop if empty.
+	UDPMaxSessions     int
+	UDPSessionOverflow UDPOverflow
+
+	// TunnelBufferSize is how much tunnels copy at once when the kernel
+	// cannot copy between the sockets directly, tcp.DefaultBufferSize if zero
+	TunnelBufferSize int
+}
+
+func (c Config) Validate() error {
+	if len(c.Secret) == 0 && len(c.Secrets) == 0 && !c.TLS.RequireClientCert {
+		return fmt.Errorf("A secret or required client certificates must be configured")
+	}
+	if c.TLS.RequireClientCert && (!c.TLS.Enabled() || len(c.TLS.ClientCAFile) == 0) {
+		return fmt.Errorf("Requiring client certificates needs a TLS certificate, key and client CA file")
+	}
+	if len(c.Secret) > 0 && len(c.Secret) < protocol.MinSecretLength {
+		return fmt.Errorf("Secret must be at least %d bytes", protocol.MinSecretLength)
+	}
+	if _, err := ParseStrategy(string(c.LoadBalancing)); err != nil {
+		return err
+	}
+	if c.DataConnPoolMinIdle < 0 || c.DataConnPoolMinIdle > c.DataConnPoolMaxIdle {
+		return fmt.Errorf("Invalid data connection pool size %d-%d", c.DataConnPoolMinIdle, c.DataConnPoolMaxIdle)
+	}
+	if c.UDPMaxSessions < 0 {
+		return fmt.Errorf("Invalid UDP session limit %d", c.UDPMaxSessions)
+	}
+	if _, err := ParseUDPOverflow(string(c.UDPSessionOverflow)); err != nil {
+		return err
+	}
+	if c.AssignPorts.Min > c.AssignPorts.Max {
+		return fmt.Errorf("Invalid port range %s", c.AssignPorts)
+	}
+	if _, err := c.dialRules(Policy{}); err != nil {
+		return err
+	}
+	for _, policy := range c.Secrets {
+		if _, err := c.dialRules(policy.Policy); err != nil {
+			return err
+		}
+	}
+	for _, policy := range c.Identities {
+		if _, err := c.dialRules(policy.Policy); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, policy := range c.Secrets {
+		if len(policy.Name) == 0 || names[policy.Name] {
+			return fmt.Errorf("Secrets must have unique non empty names")
+		}
+		names[policy.Name] = true
+		if len(policy.Secret) < protocol.MinSecretLength {
+			return fmt.Errorf("Secret for %s must be at least %d bytes", policy.Name, protocol.MinSecretLength)
+		}
+		for _, other := range c.Secrets {
+			if other.Name != policy.Name && bytes.Equal(other.Secret, policy.Secret) {
+				return fmt.Errorf("Secrets for %s and %s are the same", policy.Name, other.Name)
+			}
+		}
+		if bytes.Equal(c.Secret, policy.Secret) {
+			return fmt.Errorf("Secret for %s is the same as the global secret", policy.Name)
+		}
+	}
+	// backends are owned by name, so two credentials may not share one
+	for _, policy := range c.Identities {
+		if len(policy.Name) == 0 || names[policy.Name] {
+			return fmt.Errorf("Identities must have unique non empty names not used by any secret")
+		}
+		names[policy.Name] = true
+	}
+	return nil
+}
+
+// dialRules combines the server's destinations with the policy's, the
+// server's allowlist is nil if nothing may be dialed.
+func (c Config) dialRules(policy Policy) (tcp.Rules, error) {
+	rules := tcp.Rules{}
+	for _, entries := range [][]string{c.Destinations, policy.Destinations} {
+		list, err := tcp.ParseAddressList(entries)
+		if err != nil {
+			return rules, err
+		}
+		rules.Allow = append(rules.Allow, list)
+	}
+	for _, entries := range [][]string{c.DeniedDestinations, policy.DeniedDestinations} {
+		list, err := tcp.ParseAddressList(entries)
+		if err != nil {
+			return rules, err
+		}
+		rules.Deny = append(rules.Deny, list)
+	}
+	return rules, nil
 }
 
 // Resolve populates configuration fields from a variety of input sources
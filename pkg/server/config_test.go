@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+func TestValidateRequireClientCert(t *testing.T) {
+	tlsConfig := TLSConfig{CertFile: "server.pem", KeyFile: "server.key", ClientCAFile: "ca.pem", RequireClientCert: true}
+	if err := (Config{TLS: tlsConfig}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	withoutTLS := tlsConfig
+	withoutTLS.CertFile, withoutTLS.KeyFile = "", ""
+	if (Config{TLS: withoutTLS}).Validate() == nil {
+		t.Fatal("required client certificates without TLS")
+	}
+	withoutCA := tlsConfig
+	withoutCA.ClientCAFile = ""
+	if (Config{TLS: withoutCA}).Validate() == nil {
+		t.Fatal("required client certificates without a CA to verify them")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, protocol.MinSecretLength)
+	}
+	for _, c := range []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{name: "global secret", config: Config{Secret: secret(1)}, valid: true},
+		{name: "no credentials", config: Config{}},
+		{name: "short secret", config: Config{Secret: []byte("short")}},
+		{name: "named secrets", config: Config{Secrets: []SecretPolicy{{Name: "a", Secret: secret(1)}, {Name: "b", Secret: secret(2)}}}, valid: true},
+		{name: "unnamed secret", config: Config{Secrets: []SecretPolicy{{Secret: secret(1)}}}},
+		{name: "duplicate secret names", config: Config{Secrets: []SecretPolicy{{Name: "a", Secret: secret(1)}, {Name: "a", Secret: secret(2)}}}},
+		{name: "reused secret", config: Config{Secrets: []SecretPolicy{{Name: "a", Secret: secret(1)}, {Name: "b", Secret: secret(1)}}}},
+		{name: "global secret reused", config: Config{Secret: secret(1), Secrets: []SecretPolicy{{Name: "a", Secret: secret(1)}}}},
+		{name: "identities", config: Config{Secret: secret(1), Identities: []IdentityPolicy{{Name: "a"}, {Name: "b"}}}, valid: true},
+		{name: "unnamed identity", config: Config{Secret: secret(1), Identities: []IdentityPolicy{{}}}},
+		{name: "duplicate identities", config: Config{Secret: secret(1), Identities: []IdentityPolicy{{Name: "a"}, {Name: "a"}}}},
+		{name: "identity named like a secret", config: Config{Secrets: []SecretPolicy{{Name: "a", Secret: secret(1)}}, Identities: []IdentityPolicy{{Name: "a"}}}},
+		{name: "udp session limit", config: Config{Secret: secret(1), UDPMaxSessions: 10, UDPSessionOverflow: UDPOverflowEvict}, valid: true},
+		{name: "negative udp session limit", config: Config{Secret: secret(1), UDPMaxSessions: -1}},
+		{name: "unknown udp session overflow", config: Config{Secret: secret(1), UDPSessionOverflow: "queue"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.config.Validate()
+			if (err == nil) != c.valid {
+				t.Fatalf("valid %v want %v %v", err == nil, c.valid, err)
+			}
+		})
+	}
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"context"
-	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 	"github.com/mat285/tcptunnel/pkg/protocol"
@@ -18,13 +20,15 @@ type ConnServer struct {
 	running bool
 	stop    chan struct{}
 
+	host   string
 	port   uint16
 	server *Server
 }
 
-func NewConnServer(server *Server, port uint16) *ConnServer {
+func NewConnServer(server *Server, host string, port uint16) *ConnServer {
 	return &ConnServer{
 		running: false,
+		host:    host,
 		port:    port,
 		server:  server,
 	}
@@ -56,10 +60,19 @@ func (s *ConnServer) Listen(ctx context.Context) error {
 	s.running = true
 	s.lock.Unlock()
 
-	listener, err := tcp.Listen(ctx, s.port)
+	listener, err := tcp.Listen(ctx, s.host, s.port)
 	if err != nil {
 		return err
 	}
+	if s.server.config.TLS.Enabled() {
+		tlsConfig, err := s.server.config.TLS.ServerConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	go tcp.CloseOnStop(ctx, stop, listener)
 
 	defer func() {
 		s.lock.Lock()
@@ -84,49 +97,292 @@ func (s *ConnServer) Listen(ctx context.Context) error {
 			logger.MaybeErrorfContext(ctx, log, "Error listening for new tcp connections in server %s", err.Error())
 			continue
 		}
-		clientHello, err := protocol.ParseClientHello(conn)
-		if err != nil {
-			conn.Close()
-			logger.MaybeErrorfContext(ctx, log, "Error verifying connection for tcp server %s", err.Error())
+		if conn == nil {
 			continue
 		}
+		go s.handleConn(ctx, conn)
+	}
+}
 
-		if subtle.ConstantTimeCompare(clientHello.Secret, s.server.config.Secret) != 1 {
-			// deny connection
-			conn.Close()
-			logger.MaybeErrorfContext(ctx, log, "Wrong Server secret")
-			continue
+func (s *ConnServer) handleConn(ctx context.Context, conn net.Conn) {
+	log := logger.GetLogger(ctx)
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout()))
+	frame, err := protocol.NewFrameReader(conn).ReadFrame()
+	if err != nil {
+		s.reject(ctx, conn, protocol.Reject(protocol.RejectCodeMalformedHello, "%s", err.Error()))
+		logger.MaybeErrorfContext(ctx, log, "Error verifying connection for tcp server %s", err.Error())
+		return
+	}
+
+	// the version comes first so a hello with a layout we don't know is
+	// refused for its version rather than as malformed
+	minVersion, maxVersion, err := protocol.ParseHelloVersions(frame)
+	if err != nil {
+		s.reject(ctx, conn, protocol.Reject(protocol.RejectCodeMalformedHello, "%s", err.Error()))
+		logger.MaybeErrorfContext(ctx, log, "Error verifying connection for tcp server %s", err.Error())
+		return
+	}
+	version, err := protocol.NegotiateVersion(protocol.MinProtocolVersion, protocol.ProtocolVersion, minVersion, maxVersion)
+	if err != nil {
+		s.reject(ctx, conn, protocol.Reject(protocol.RejectCodeUnsupportedVersion, "%s", err.Error()))
+		logger.MaybeErrorfContext(ctx, log, "Rejecting client %s %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	clientHello, err := protocol.ParseClientHelloFrame(frame)
+	if err != nil {
+		s.reject(ctx, conn, protocol.Reject(protocol.RejectCodeMalformedHello, "%s", err.Error()))
+		logger.MaybeErrorfContext(ctx, log, "Error verifying connection for tcp server %s", err.Error())
+		return
+	}
+
+	switch clientHello.Type {
+	case protocol.ClientHelloTypeCommand, protocol.ClientHelloTypeData, protocol.ClientHelloTypeDial, protocol.ClientHelloTypeUDP:
+	default:
+		s.reject(ctx, conn, protocol.Reject(protocol.RejectCodeMalformedHello, "Unknown hello type %d", clientHello.Type))
+		logger.MaybeErrorfContext(ctx, log, "Rejecting client %s with unknown hello type %d", conn.RemoteAddr(), clientHello.Type)
+		return
+	}
+
+	identity, transcript, secret, err := s.authenticate(ctx, conn, frame)
+	if err != nil {
+		s.reject(ctx, conn, err)
+		logger.MaybeErrorfContext(ctx, log, "Error authenticating client %s %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	serverHello := protocol.ServerHello{
+		Type:         protocol.TypeServerHello,
+		Version:      version,
+		Capabilities: clientHello.Capabilities & s.server.capabilities(),
+		ID:           clientHello.ID,
+		Port:         clientHello.Port,
+	}
+
+	if clientHello.Type == protocol.ClientHelloTypeData {
+		serverHello.Proof = s.proof(transcript, secret, serverHello)
+		conn.SetDeadline(time.Time{})
+		err = s.server.ConnectTargetDataConn(ctx, clientHello, identity, tcp.WrappedConn{Conn: conn}, serverHello.Frame())
+		if err != nil {
+			s.reject(ctx, conn, err)
+			logger.MaybeErrorfContext(ctx, log, "Error adding data connection %s", err.Error())
 		}
+		return
+	}
 
-		if clientHello.Type == protocol.ClientHelloTypeData {
+	if clientHello.Type == protocol.ClientHelloTypeDial {
+		s.handleDial(ctx, conn, clientHello, identity, serverHello, transcript, secret)
+		return
+	}
 
-			err = s.server.ConnectTargetDataConn(ctx, clientHello, tcp.WrappedConn{Conn: conn})
-			if err != nil {
-				conn.Close()
-				logger.MaybeErrorfContext(ctx, log, "Error adding data connection %s", err.Error())
-				continue
-			}
-		} else {
-			serverHello := protocol.ServerHello{
-				Type:   protocol.TypeServerHello,
-				ID:     rand.Uint64(),
-				Port:   clientHello.Port,
-				Secret: clientHello.Secret,
-			}
-			clientHello.ID = serverHello.ID
+	if clientHello.Type == protocol.ClientHelloTypeUDP {
+		s.handleUDP(ctx, conn, clientHello, identity, serverHello, transcript, secret)
+		return
+	}
 
-			target := NewTarget(serverHello.ID, tcp.WrapConn(conn))
+	resume := len(clientHello.ResumeToken) > 0
+	if !resume {
+		serverHello.ID = rand.Uint64()
+		clientHello.ID = serverHello.ID
+	}
 
-			_, err = s.server.CreateOrVerifyBackend(ctx, clientHello, target)
-			if err != nil {
-				conn.Close()
-				logger.MaybeErrorfContext(ctx, log, "Error verifying or creating backend %s", err.Error())
-				continue
-			}
-			conn.Write(serverHello.Serialize())
+	session := NewSession(serverHello.ID, protocol.NewCmdConn(conn), serverHello.Capabilities)
+	session.Version = serverHello.Version
+	session.Identity = *identity
+	if serverHello.Capabilities.Has(protocol.CapabilityHeartbeat) {
+		session.SetHeartbeat(protocol.NewHeartbeat(s.server.config.HeartbeatInterval, s.server.config.HeartbeatMaxMissed))
+	}
+	forwards := clientHello.AllForwards()
+	if !serverHello.Capabilities.Has(protocol.CapabilityForwards) {
+		forwards = forwards[:1]
+	}
+	for _, forward := range forwards {
+		target := session.AddTarget(forward)
+		// streams are already cheap to open, there is nothing to pool
+		if serverHello.Capabilities.Has(protocol.CapabilityConnPool) && !serverHello.Capabilities.Has(protocol.CapabilityMultiplex) {
+			target.SetPool(s.server.config.DataConnPoolMinIdle, s.server.config.DataConnPoolMaxIdle)
 		}
+	}
 
+	if serverHello.Capabilities.Has(protocol.CapabilityResume) {
+		token, err := protocol.NewResumeToken()
+		if err != nil {
+			s.reject(ctx, conn, err)
+			return
+		}
+		serverHello.ResumeToken = token
+		session.resumeToken = token
 	}
+
+	if resume {
+		err = s.server.ResumeSession(ctx, clientHello, session)
+	} else {
+		err = s.server.RegisterSession(ctx, session, forwards)
+	}
+	if err != nil {
+		s.reject(ctx, conn, err)
+		logger.MaybeErrorfContext(ctx, log, "Error verifying or creating backend %s", err.Error())
+		return
+	}
+	// the ports are only known once the backends are assigned
+	targets := session.Targets()
+	serverHello.Port = targets[0].Port
+	for _, target := range targets[1:] {
+		serverHello.Ports = append(serverHello.Ports, target.Port)
+	}
+	serverHello.Proof = s.proof(transcript, secret, serverHello)
+	defer session.MarkReady()
+	err = session.cmdConn.WriteFrame(ctx, serverHello.Frame())
+	if err != nil {
+		session.Close(ctx)
+		s.server.RemoveSession(ctx, session)
+		logger.MaybeErrorfContext(ctx, log, "Error writing server hello %s", err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	go s.runSession(ctx, session)
+}
+
+func (s *ConnServer) runSession(ctx context.Context, session *Session) {
+	err := session.Run(ctx)
+	if err != nil {
+		logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Session %d (%s) disconnected %s", session.ID, session.Identity, err.Error())
+	}
+	s.server.RemoveSession(ctx, session)
+}
+
+// handleDial dials the destination the client asked for and carries the
+// connection to it once the server hello is sent.
+func (s *ConnServer) handleDial(ctx context.Context, conn net.Conn, hello *protocol.ClientHello, identity *Identity, serverHello protocol.ServerHello, transcript *protocol.Transcript, secret []byte) {
+	log := logger.GetLogger(ctx)
+	upstream, err := s.server.DialDestination(ctx, identity, hello.Destination)
+	if err != nil {
+		s.reject(ctx, conn, err)
+		logger.MaybeErrorfContext(ctx, log, "Error dialing %s for %s %s", hello.Destination, identity, err.Error())
+		return
+	}
+	serverHello.Proof = s.proof(transcript, secret, serverHello)
+	_, err = conn.Write(serverHello.Serialize())
+	if err != nil {
+		upstream.Close()
+		conn.Close()
+		logger.MaybeErrorfContext(ctx, log, "Error writing server hello %s", err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	logger.MaybeDebugfContext(ctx, log, "Dialed %s for %s", hello.Destination, identity)
+	s.server.runTunnel(ctx, tcp.NewTunnel(tcp.WrappedConn{Conn: conn}, tcp.WrappedConn{Conn: upstream}))
+}
+
+// handleUDP binds the UDP port the client asked for and carries its
+// datagrams over the connection once the server hello is sent.
+func (s *ConnServer) handleUDP(ctx context.Context, conn net.Conn, hello *protocol.ClientHello, identity *Identity, serverHello protocol.ServerHello, transcript *protocol.Transcript, secret []byte) {
+	log := logger.GetLogger(ctx)
+	if serverHello.Capabilities.Has(protocol.CapabilityResume) {
+		token, err := protocol.NewResumeToken()
+		if err != nil {
+			s.reject(ctx, conn, err)
+			return
+		}
+		serverHello.ResumeToken = token
+	}
+	cmdConn := protocol.NewCmdConn(conn)
+	backend, err := s.server.RegisterUDP(ctx, identity, hello, serverHello.ResumeToken, cmdConn)
+	if err != nil {
+		s.reject(ctx, conn, err)
+		logger.MaybeErrorfContext(ctx, log, "Error creating UDP backend %s", err.Error())
+		return
+	}
+	if serverHello.Capabilities.Has(protocol.CapabilityHeartbeat) {
+		backend.SetHeartbeat(protocol.NewHeartbeat(s.server.config.HeartbeatInterval, s.server.config.HeartbeatMaxMissed))
+	}
+	serverHello.Proof = s.proof(transcript, secret, serverHello)
+	err = cmdConn.WriteFrame(ctx, serverHello.Frame())
+	if err != nil {
+		s.server.RemoveUDP(ctx, backend)
+		logger.MaybeErrorfContext(ctx, log, "Error writing server hello %s", err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	logger.MaybeDebugfContext(ctx, log, "Forwarding UDP port %d for %s", backend.Port(), identity)
+	go s.server.runUDP(ctx, backend)
+}
+
+// authenticate establishes who the client is from its certificate and, when
+// the server has secrets, by challenging the client to prove it knows one. The
+// returned transcript and secret are nil if there was no challenge.
+func (s *ConnServer) authenticate(ctx context.Context, conn net.Conn, hello *protocol.Frame) (*Identity, *protocol.Transcript, []byte, error) {
+	identity, err := s.server.certificateIdentity(conn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(s.server.config.Secret) == 0 && len(s.server.config.Secrets) == 0 {
+		if identity == nil {
+			return nil, nil, nil, protocol.Reject(protocol.RejectCodeAuthenticationFailed, "Client certificate required")
+		}
+		return identity, nil, nil, nil
+	}
+
+	nonce, err := protocol.NewNonce()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = conn.Write(protocol.Challenge{Nonce: nonce}.Frame().Serialize())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	frame, err := protocol.NewFrameReader(conn).ReadFrame()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	response, err := protocol.ParseChallengeResponseFrame(frame)
+	if err != nil {
+		return nil, nil, nil, protocol.Reject(protocol.RejectCodeMalformedHello, "%s", err.Error())
+	}
+
+	transcript := protocol.Transcript{
+		ServerNonce: nonce,
+		ClientNonce: response.Nonce,
+		ClientHello: hello.Serialize(),
+	}
+	secretIdentity, secret := s.server.secretIdentity(transcript, response.Proof)
+	if secretIdentity == nil {
+		return nil, nil, nil, protocol.Reject(protocol.RejectCodeAuthenticationFailed, "Wrong server secret")
+	}
+	// a certificate is the more specific identity
+	if identity == nil {
+		identity = secretIdentity
+	}
+	return identity, &transcript, secret, nil
+}
+
+// proof is the server half of the challenge-response, empty if the client was
+// not challenged.
+func (s *ConnServer) proof(transcript *protocol.Transcript, secret []byte, hello protocol.ServerHello) []byte {
+	if transcript == nil {
+		return nil
+	}
+	return transcript.ServerProof(secret, hello)
+}
+
+// reject tells the client why its connection is being refused, if the error
+// is one it should see, and closes the connection.
+func (s *ConnServer) reject(ctx context.Context, conn net.Conn, err error) {
+	var reject *protocol.RejectError
+	if errors.As(err, &reject) {
+		_, werr := conn.Write(reject.Frame().Serialize())
+		if werr != nil {
+			logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Error writing reject to %s %s", conn.RemoteAddr(), werr.Error())
+		}
+	}
+	conn.Close()
+}
+
+func (s *ConnServer) handshakeTimeout() time.Duration {
+	if s.server.config.ClientConnectTimeout > 0 {
+		return s.server.config.ClientConnectTimeout
+	}
+	return DefaultClientConnectTimeout
 }
 
 func (s *ConnServer) listenForNew(ctx context.Context, stop chan struct{}, listener net.Listener) (net.Conn, error) {
@@ -142,13 +398,12 @@ func (s *ConnServer) listenForNew(ctx context.Context, stop chan struct{}, liste
 
 		conn, err := listener.Accept()
 		if err != nil {
+			if tcp.Stopped(ctx, stop) {
+				return nil, nil
+			}
 			logger.MaybeErrorfContext(ctx, log, "Error accepting connection %s", err.Error())
 			continue
 		}
 		return conn, err
 	}
 }
-
-func (s *ConnServer) RequestDataConnForTarget(ctx context.Context, target *Target) error {
-	return target.cmdConn.Write(ctx, []byte{protocol.ClientHelloTypeData})
-}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+// DialDestination dials the destination of a dial hello, both the server's
+// Destinations and the identity's policy must allow it.
+func (s *Server) DialDestination(ctx context.Context, identity *Identity, destination string) (net.Conn, error) {
+	err := tcp.ValidateAddress(destination)
+	if err != nil {
+		return nil, protocol.Reject(protocol.RejectCodeMalformedHello, "Invalid destination %s %s", destination, err.Error())
+	}
+	// the rules were checked when the server started
+	rules, _ := s.config.dialRules(identity.Policy)
+	if rules.Allow[0] == nil {
+		return nil, protocol.Reject(protocol.RejectCodeDestinationDenied, "Server does not dial destinations")
+	}
+	timeout := s.config.DialTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	conn, err := tcp.Dial(ctx, destination, timeout, rules)
+	if errors.Is(err, tcp.ErrDestinationNotAllowed) {
+		return nil, protocol.Reject(protocol.RejectCodeDestinationDenied, "%s may not dial %s", identity, destination)
+	}
+	if err != nil {
+		return nil, protocol.Reject(protocol.RejectCodeDialFailed, "%s", err.Error())
+	}
+	return conn, nil
+}
+
+// runTunnel runs a tunnel the server owns, it is stopped with the server.
+func (s *Server) runTunnel(ctx context.Context, tunnel *tcp.Tunnel) {
+	s.lock.Lock()
+	s.tunnels[tunnel] = struct{}{}
+	s.lock.Unlock()
+	tunnel.Run(ctx)
+	s.lock.Lock()
+	delete(s.tunnels, tunnel)
+	s.lock.Unlock()
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+func TestDialDestination(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	open := listener.Addr().String()
+	closed := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	for _, c := range []struct {
+		name         string
+		destinations []string
+		denied       []string
+		policy       []string
+		destination  string
+		code         protocol.RejectCode
+	}{
+		{name: "allowed", destinations: []string{"127.0.0.0/8:*"}, destination: open},
+		{name: "server dials nothing", destination: open, code: protocol.RejectCodeDestinationDenied},
+		{name: "outside the server's destinations", destinations: []string{"10.0.0.0/8:*"}, destination: open, code: protocol.RejectCodeDestinationDenied},
+		{name: "outside the identity's policy", destinations: []string{"127.0.0.0/8:*"}, policy: []string{"unix:/run/*.sock"}, destination: open, code: protocol.RejectCodeDestinationDenied},
+		{name: "inside the identity's policy", destinations: []string{"127.0.0.0/8:*"}, policy: []string{open}, destination: open},
+		{name: "denied by the server", destinations: []string{"127.0.0.0/8:*"}, denied: []string{open}, destination: open, code: protocol.RejectCodeDestinationDenied},
+		{name: "malformed destination", destinations: []string{"127.0.0.0/8:*"}, destination: "127.0.0.1", code: protocol.RejectCodeMalformedHello},
+		{name: "nothing listening", destinations: []string{"127.0.0.0/8:*"}, destination: closed, code: protocol.RejectCodeDialFailed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := NewServer(Config{Destinations: c.destinations, DeniedDestinations: c.denied})
+			identity := &Identity{Name: "alice", Policy: Policy{Destinations: c.policy}}
+			conn, err := server.DialDestination(context.Background(), identity, c.destination)
+			if c.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			var reject *protocol.RejectError
+			if !errors.As(err, &reject) || reject.Code != c.code {
+				t.Fatalf("got %v want code %s", err, c.code)
+			}
+		})
+	}
+}
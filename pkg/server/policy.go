@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// Policy limits what an authenticated client may claim on the server. The
+// server's own control port is never allowed.
+type Policy struct {
+	// Ports the client may claim, any port if empty
+	Ports []PortRange
+	// MaxBackends is how many ports the client may hold at once, unlimited
+	// if zero
+	MaxBackends int
+	// BindAddresses the client's backends may listen on, only the server
+	// default if empty
+	BindAddresses []string
+	// Destinations further limit what the client may ask the server to dial
+	// beyond the server's own Destinations, no further limit if empty
+	Destinations []string
+	// DeniedDestinations are never dialed for the client
+	DeniedDestinations []string
+}
+
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return fmt.Sprintf("%d", r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func (p Policy) AllowsPort(port uint16) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, r := range p.Ports {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) AllowsBackends(count int) bool {
+	return p.MaxBackends <= 0 || count <= p.MaxBackends
+}
+
+// AllowsBind reports whether backends may listen on host, the empty host is
+// the server default and always allowed.
+func (p Policy) AllowsBind(host string) bool {
+	if len(host) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	for _, allowed := range p.BindAddresses {
+		if allowed == host || (ip != nil && ip.Equal(net.ParseIP(allowed))) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretPolicy authorizes clients that prove they know Secret as Name.
+type SecretPolicy struct {
+	Name   string
+	Secret []byte
+	Policy Policy
+}
+
+// IdentityPolicy authorizes clients whose certificate subject common name or
+// any subject alternative name equals Name.
+type IdentityPolicy struct {
+	Name   string
+	Policy Policy
+}
+
+// Identity is who a client authenticated as. Clients authenticated only by
+// the global shared secret have an empty name.
+type Identity struct {
+	Name   string
+	Policy Policy
+}
+
+func (i Identity) String() string {
+	if len(i.Name) == 0 {
+		return "<secret>"
+	}
+	return i.Name
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// peerCertificate returns the verified client certificate of a TLS connection,
+// if there is one.
+func peerCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	// the handshake normally happens lazily on the first read, which has
+	// already happened by the time we authenticate
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	return state.PeerCertificates[0], nil
+}
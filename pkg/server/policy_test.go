@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+func TestPolicyAllowsPort(t *testing.T) {
+	policy := Policy{Ports: []PortRange{{Min: 80, Max: 80}, {Min: 8000, Max: 8100}}}
+	for _, c := range []struct {
+		policy Policy
+		port   uint16
+		allow  bool
+	}{
+		{Policy{}, 22, true},
+		{policy, 80, true},
+		{policy, 81, false},
+		{policy, 8000, true},
+		{policy, 8100, true},
+		{policy, 8101, false},
+	} {
+		if c.policy.AllowsPort(c.port) != c.allow {
+			t.Fatalf("%v port %d allow %v", c.policy.Ports, c.port, !c.allow)
+		}
+	}
+}
+
+func TestPolicyAllowsBackends(t *testing.T) {
+	for _, c := range []struct {
+		max   int
+		count int
+		allow bool
+	}{
+		{0, 100, true},
+		{2, 1, true},
+		{2, 2, true},
+		{2, 3, false},
+	} {
+		if (Policy{MaxBackends: c.max}).AllowsBackends(c.count) != c.allow {
+			t.Fatalf("max %d count %d allow %v", c.max, c.count, !c.allow)
+		}
+	}
+}
+
+func TestPolicyAllowsBind(t *testing.T) {
+	policy := Policy{BindAddresses: []string{"127.0.0.1", "::1", "localhost"}}
+	for _, c := range []struct {
+		host  string
+		allow bool
+	}{
+		{"", true},
+		{"127.0.0.1", true},
+		{"0:0:0:0:0:0:0:1", true},
+		{"localhost", true},
+		{"0.0.0.0", false},
+		{"example.com", false},
+	} {
+		if policy.AllowsBind(c.host) != c.allow {
+			t.Fatalf("host %q allow %v", c.host, !c.allow)
+		}
+	}
+	if (Policy{}).AllowsBind("127.0.0.1") {
+		t.Fatal("empty policy allowed a bind address")
+	}
+}
+
+func TestBackendPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	controlPort, limited, open, loopback := freePort(t), freePort(t), freePort(t), freePort(t)
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	inUse := uint16(held.Addr().(*net.TCPAddr).Port)
+	server := NewServer(Config{Port: controlPort})
+	alice := &Identity{Name: "alice", Policy: Policy{Ports: []PortRange{{Min: limited, Max: limited}}, MaxBackends: 1}}
+	bob := &Identity{Name: "bob"}
+	carol := &Identity{Name: "carol", Policy: Policy{BindAddresses: []string{"127.0.0.1", "192.0.2.1"}}}
+
+	for i, c := range []struct {
+		name     string
+		identity *Identity
+		port     uint16
+		bindHost string
+		code     protocol.RejectCode
+	}{
+		{name: "control port", identity: bob, port: controlPort, code: protocol.RejectCodePortNotAllowed},
+		{name: "port outside policy", identity: alice, port: open, code: protocol.RejectCodePortNotAllowed},
+		{name: "port inside policy", identity: alice, port: limited},
+		{name: "port owned by another client", identity: bob, port: limited, code: protocol.RejectCodeBackendOwnerMismatch},
+		{name: "second target of the owner", identity: alice, port: limited},
+		{name: "unrestricted client", identity: bob, port: open},
+		{name: "bind outside policy", identity: bob, port: loopback, bindHost: "127.0.0.1", code: protocol.RejectCodeBindNotAllowed},
+		{name: "bind inside policy", identity: carol, port: loopback, bindHost: "127.0.0.1"},
+		{name: "bind host that is not ours", identity: carol, port: loopback + 1, bindHost: "192.0.2.1", code: protocol.RejectCodeBindNotAllowed},
+		{name: "port in use", identity: carol, port: inUse, bindHost: "127.0.0.1", code: protocol.RejectCodePortInUse},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			forwards := []protocol.Forward{{Port: c.port, BindHost: c.bindHost}}
+			session, remote := newPipeSession(uint64(i+1), forwards...)
+			defer remote.Close()
+			session.Identity = *c.identity
+			err := server.RegisterSession(ctx, session, forwards)
+			var reject *protocol.RejectError
+			if c.code == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if c.code != 0 && (!errors.As(err, &reject) || reject.Code != c.code) {
+				t.Fatalf("got %v want code %s", err, c.code)
+			}
+		})
+	}
+
+	// the backend limit counts ports, not targets
+	alice.Policy.Ports = nil
+	forwards := []protocol.Forward{{Port: open + 1}}
+	session, remote := newPipeSession(100, forwards...)
+	defer remote.Close()
+	session.Identity = *alice
+	err = server.RegisterSession(ctx, session, forwards)
+	var reject *protocol.RejectError
+	if !errors.As(err, &reject) || reject.Code != protocol.RejectCodeBackendLimit {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestSecretIdentity(t *testing.T) {
+	global := []byte("0123456789abcdef0123456789abcdef")
+	own := []byte("fedcba9876543210fedcba9876543210")
+	limited := Policy{Ports: []PortRange{{Min: 8000, Max: 8000}}}
+	server := NewServer(Config{
+		Secret:       global,
+		SecretPolicy: limited,
+		Secrets:      []SecretPolicy{{Name: "alice", Secret: own, Policy: Policy{MaxBackends: 1}}},
+	})
+	nonce, _ := protocol.NewNonce()
+	transcript := protocol.Transcript{ServerNonce: nonce, ClientNonce: nonce}
+
+	for _, c := range []struct {
+		name   string
+		secret []byte
+		want   *Identity
+	}{
+		{name: "global secret", secret: global, want: &Identity{Policy: limited}},
+		{name: "client secret", secret: own, want: &Identity{Name: "alice", Policy: Policy{MaxBackends: 1}}},
+		{name: "unknown secret", secret: []byte("another secret of thirty-two by")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			identity, secret := server.secretIdentity(transcript, transcript.ClientProof(c.secret))
+			if c.want == nil {
+				if identity != nil {
+					t.Fatalf("authenticated as %s", identity)
+				}
+				return
+			}
+			if identity == nil || !reflect.DeepEqual(*identity, *c.want) || !bytes.Equal(secret, c.secret) {
+				t.Fatalf("got %v want %v", identity, c.want)
+			}
+		})
+	}
+}
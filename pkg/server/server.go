@@ -2,8 +2,13 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
+	"errors"
 	"fmt"
+	"net"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 	"github.com/mat285/tcptunnel/pkg/protocol"
@@ -19,23 +24,45 @@ type Server struct {
 
 	connServer *ConnServer
 
-	targets map[uint64]*Target
+	sessions map[uint64]*Session
+	tunnels  map[*tcp.Tunnel]struct{}
 
-	backends map[uint16]*Backend // inbound traffic for port maps to serving backends
+	backends    map[uint16]*Backend // inbound traffic for port maps to serving backends
+	udpBackends map[uint16]*UDPBackend
 }
 
 func NewServer(cfg Config) *Server {
 	server := &Server{
-		config:   cfg,
-		backends: make(map[uint16]*Backend),
-		targets:  make(map[uint64]*Target),
+		config:      cfg,
+		backends:    make(map[uint16]*Backend),
+		udpBackends: make(map[uint16]*UDPBackend),
+		sessions:    make(map[uint64]*Session),
+		tunnels:     make(map[*tcp.Tunnel]struct{}),
 	}
-	server.connServer = NewConnServer(server, cfg.Port)
+	server.connServer = NewConnServer(server, cfg.BindHost, cfg.Port)
 	return server
 }
 
+func (s *Server) capabilities() protocol.Capabilities {
+	capabilities := protocol.SupportedCapabilities
+	if s.config.DisableMultiplex {
+		capabilities &^= protocol.CapabilityMultiplex
+	}
+	if s.config.DataConnPoolMaxIdle == 0 {
+		capabilities &^= protocol.CapabilityConnPool
+	}
+	if s.config.ResumeWindow <= 0 {
+		capabilities &^= protocol.CapabilityResume
+	}
+	return capabilities
+}
+
 func (s *Server) Start(ctx context.Context) error {
 	log := logger.GetLogger(ctx)
+	err := s.config.Validate()
+	if err != nil {
+		return err
+	}
 	s.lock.Lock()
 	if s.running {
 		s.lock.Unlock()
@@ -44,8 +71,9 @@ func (s *Server) Start(ctx context.Context) error {
 	s.running = true
 	s.lock.Unlock()
 
+	ctx = tcp.WithBufferPool(ctx, tcp.NewBufferPool(s.config.TunnelBufferSize))
 	logger.MaybeDebugfContext(ctx, log, "Starting conn server listen")
-	err := s.connServer.Listen(ctx)
+	err = s.connServer.Listen(ctx)
 	s.lock.Lock()
 	s.running = false
 	s.lock.Unlock()
@@ -60,54 +88,356 @@ func (s *Server) Stop() error {
 	}
 	s.connServer.Stop()
 	s.stopBackendsUnsafe()
+	sessions := s.sessions
+	s.sessions = make(map[uint64]*Session)
+	tunnels := s.tunnels
+	s.tunnels = make(map[*tcp.Tunnel]struct{})
 	s.lock.Unlock()
+	for _, session := range sessions {
+		session.Close(context.Background())
+	}
+	for tunnel := range tunnels {
+		tunnel.Stop(context.Background())
+	}
 	return nil
 }
 
+// Stats returns a snapshot of every connected target.
+func (s *Server) Stats() []TargetStats {
+	s.lock.Lock()
+	targets := make([]*Target, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		targets = append(targets, session.Targets()...)
+	}
+	s.lock.Unlock()
+	stats := make([]TargetStats, 0, len(targets))
+	for _, target := range targets {
+		stats = append(stats, target.Stats())
+	}
+	return stats
+}
+
+// certificateIdentity returns the identity of the client certificate on the
+// connection, or nil if the client did not present one.
+func (s *Server) certificateIdentity(conn net.Conn) (*Identity, error) {
+	cert, err := peerCertificate(conn)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, nil
+	}
+	for _, name := range certificateNames(cert) {
+		for _, policy := range s.config.Identities {
+			if policy.Name == name {
+				return &Identity{Name: name, Policy: policy.Policy}, nil
+			}
+		}
+	}
+	return nil, protocol.Reject(protocol.RejectCodeUnauthorized, "Client certificate %s is not authorized", cert.Subject)
+}
+
+// secretIdentity returns the identity of the secret the client proved it
+// knows along with the secret, or nil if it matches none.
+func (s *Server) secretIdentity(transcript protocol.Transcript, proof []byte) (*Identity, []byte) {
+	if len(s.config.Secret) > 0 && transcript.VerifyClientProof(s.config.Secret, proof) {
+		return &Identity{Policy: s.config.SecretPolicy}, s.config.Secret
+	}
+	for _, policy := range s.config.Secrets {
+		if transcript.VerifyClientProof(policy.Secret, proof) {
+			return &Identity{Name: policy.Name, Policy: policy.Policy}, policy.Secret
+		}
+	}
+	return nil, nil
+}
+
 func (s *Server) stopBackendsUnsafe() {
 	for _, backend := range s.backends {
 		backend.Stop()
 	}
 	s.backends = make(map[uint16]*Backend)
+	for _, backend := range s.udpBackends {
+		backend.Stop()
+	}
+	s.udpBackends = make(map[uint16]*UDPBackend)
 }
 
-func (s *Server) CreateOrVerifyBackend(ctx context.Context, hello *protocol.ClientHello, target *Target) (bool, error) {
-	log := logger.GetLogger(ctx)
+// RegisterSession creates or joins a backend for each of the session's
+// targets, either all of them are registered or none are. Targets without a
+// port are assigned one.
+func (s *Server) RegisterSession(ctx context.Context, session *Session, forwards []protocol.Forward) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if existing, has := s.backends[hello.Port]; has && existing != nil {
-		if existing.ValidSecret(hello.Secret) {
-			logger.MaybeDebugfContext(ctx, log, "Added target to existing backend")
+	seen := make(map[uint16]bool, len(forwards))
+	for _, forward := range forwards {
+		if forward.Port != 0 && seen[forward.Port] {
+			return protocol.Reject(protocol.RejectCodeMalformedHello, "Port %d is forwarded more than once", forward.Port)
+		}
+		seen[forward.Port] = true
+	}
+
+	// ports the client asked for go first so none of them is assigned to
+	// another of its forwards
+	targets := session.Targets()
+	order := make([]int, 0, len(targets))
+	for i := range targets {
+		if forwards[i].Port != 0 {
+			order = append(order, i)
+		}
+	}
+	for i := range targets {
+		if forwards[i].Port == 0 {
+			order = append(order, i)
+		}
+	}
+
+	created := make(map[*Backend]bool, len(targets))
+	registered := make([]*Target, 0, len(targets))
+	for _, i := range order {
+		backend, isNew, err := s.createOrVerifyBackendUnsafe(ctx, forwards[i], &session.Identity, targets[i])
+		if err != nil {
+			// roll back the ports already registered, new backends are
+			// stopped without a grace period as nobody ever used them
+			for _, target := range registered {
+				b := s.backends[target.Port]
+				if b != nil && b.RemoveTarget(ctx, target) == 0 && created[b] {
+					s.stopBackendUnsafe(ctx, b)
+				}
+			}
+			return err
+		}
+		created[backend] = isNew
+		registered = append(registered, targets[i])
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *Server) createOrVerifyBackendUnsafe(ctx context.Context, forward protocol.Forward, identity *Identity, target *Target) (*Backend, bool, error) {
+	log := logger.GetLogger(ctx)
+	if !identity.Policy.AllowsBind(forward.BindHost) {
+		return nil, false, protocol.Reject(protocol.RejectCodeBindNotAllowed, "%s may not listen on %s", identity, forward.BindHost)
+	}
+	host := s.bindHost(forward)
+	if target.Port == 0 {
+		port, err := s.assignPortUnsafe(host, identity)
+		if err != nil {
+			return nil, false, err
+		}
+		logger.MaybeDebugfContext(ctx, log, "Assigned port %d to target %d (%s)", port, target.ID, identity)
+		target.Port = port
+	}
+	if target.Port == s.config.Port || !identity.Policy.AllowsPort(target.Port) {
+		return nil, false, protocol.Reject(protocol.RejectCodePortNotAllowed, "%s may not claim port %d", identity, target.Port)
+	}
+	if existing, has := s.backends[target.Port]; has && existing != nil {
+		if existing.Host() != host {
+			return nil, false, protocol.Reject(protocol.RejectCodeBindNotAllowed, "Port %d is already bound to %s", target.Port, existing.Host())
+		}
+		if existing.OwnedBy(identity) {
+			if len(forward.LoadBalancing) > 0 && Strategy(forward.LoadBalancing) != existing.Strategy {
+				logger.MaybeDebugfContext(ctx, log, "Port %d already uses %s load balancing, ignoring request for %s", target.Port, existing.Strategy, forward.LoadBalancing)
+			}
+			logger.MaybeDebugfContext(ctx, log, "Added target %d (%s) to existing backend", target.ID, identity)
 			existing.AddTarget(ctx, target)
-			return false, nil
+			return existing, false, nil
 		}
-		return false, fmt.Errorf("Invalid secret for existing backend")
+		return nil, false, protocol.Reject(protocol.RejectCodeBackendOwnerMismatch, "Port %d is owned by another client", target.Port)
+	}
+	if !identity.Policy.AllowsBackends(s.ownedBackendsUnsafe(identity) + 1) {
+		return nil, false, protocol.Reject(protocol.RejectCodeBackendLimit, "%s may hold at most %d ports", identity, identity.Policy.MaxBackends)
 	}
-	logger.MaybeDebugfContext(ctx, log, "Adding target to new backend for port %d", hello.Port)
-	backend := NewBackend(hello.Port, hello.Secret)
-	s.backends[hello.Port] = backend
+	strategy, err := s.strategy(forward)
+	if err != nil {
+		return nil, false, protocol.Reject(protocol.RejectCodeMalformedHello, "%s", err.Error())
+	}
+	logger.MaybeDebugfContext(ctx, log, "Adding target %d (%s) to new %s backend for port %d", target.ID, identity, strategy, target.Port)
+	backend := NewBackend(host, target.Port, identity.Name, strategy)
+	err = backend.Bind(ctx)
+	if err != nil {
+		return nil, false, bindReject(host, target.Port, err)
+	}
+	s.backends[target.Port] = backend
 	backend.AddTarget(ctx, target)
-	s.targets[hello.ID] = target
 	go s.listenAndCleanup(ctx, backend)
-	return true, nil
+	return backend, true, nil
+}
+
+// strategy is the load balancing strategy for a new backend created for the
+// forward.
+func (s *Server) strategy(forward protocol.Forward) (Strategy, error) {
+	if len(forward.LoadBalancing) > 0 {
+		return ParseStrategy(forward.LoadBalancing)
+	}
+	return ParseStrategy(string(s.config.LoadBalancing))
 }
 
-func (s *Server) ConnectTargetDataConn(ctx context.Context, hello *protocol.ClientHello, conn tcp.Conn) error {
+// bindReject explains why a backend could not listen, hosts that are not
+// one of our addresses are refused like a bind the policy does not allow.
+func bindReject(host string, port uint16, err error) error {
+	var dnsErr *net.DNSError
+	if errors.Is(err, syscall.EADDRNOTAVAIL) || errors.As(err, &dnsErr) {
+		return protocol.Reject(protocol.RejectCodeBindNotAllowed, "Cannot listen on %s %s", host, err.Error())
+	}
+	return protocol.Reject(protocol.RejectCodePortInUse, "Cannot listen on port %d %s", port, err.Error())
+}
+
+// bindHost is the address the backend for the forward listens on.
+func (s *Server) bindHost(forward protocol.Forward) string {
+	if len(forward.BindHost) > 0 {
+		return forward.BindHost
+	}
+	return s.config.BackendBindHost
+}
+
+// assignPortUnsafe picks a free port from the assignment range that the
+// identity may claim.
+func (s *Server) assignPortUnsafe(host string, identity *Identity) (uint16, error) {
+	r := s.config.AssignPorts
+	if r.Min == 0 {
+		return 0, protocol.Reject(protocol.RejectCodePortNotAllowed, "Server does not assign ports")
+	}
+	for port := uint32(r.Min); port <= uint32(r.Max); port++ {
+		candidate := uint16(port)
+		if _, has := s.backends[candidate]; has || candidate == s.config.Port || !identity.Policy.AllowsPort(candidate) {
+			continue
+		}
+		if tcp.PortFree(host, candidate) {
+			return candidate, nil
+		}
+	}
+	return 0, protocol.Reject(protocol.RejectCodeNoPortAvailable, "No free port in %s", r)
+}
+
+func (s *Server) ownedBackendsUnsafe(identity *Identity) int {
+	count := 0
+	for _, backend := range s.backends {
+		if backend.OwnedBy(identity) {
+			count++
+		}
+	}
+	for _, backend := range s.udpBackends {
+		if backend.OwnedBy(identity) {
+			count++
+		}
+	}
+	return count
+}
+
+// RemoveSession deregisters a closed session. Sessions that can be resumed
+// keep their place for the resume window first. Once the last target of a
+// backend is gone the backend is stopped, after the configured grace period to
+// allow clients to reconnect.
+func (s *Server) RemoveSession(ctx context.Context, session *Session) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	window := s.config.ResumeWindow
+	if window <= 0 || len(session.resumeToken) == 0 || s.sessions[session.ID] != session {
+		s.removeSessionUnsafe(ctx, session)
+		return
+	}
+	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Keeping session %d (%s) for %s to be resumed", session.ID, session.Identity, window)
+	time.AfterFunc(window, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.sessions[session.ID] == session {
+			s.removeSessionUnsafe(ctx, session)
+		}
+	})
+}
+
+// ResumeSession gives a reconnected client the place of its disconnected
+// session, the client proves it owned the session with the resume token. The
+// new session takes over the ports of the old one's targets in order.
+func (s *Server) ResumeSession(ctx context.Context, hello *protocol.ClientHello, session *Session) error {
+	s.lock.Lock()
+	old := s.sessions[hello.ID]
+	if old == nil || len(old.resumeToken) == 0 || !hmac.Equal(old.resumeToken, hello.ResumeToken) || old.Identity.Name != session.Identity.Name {
+		s.lock.Unlock()
+		return protocol.Reject(protocol.RejectCodeResumeFailed, "No session %d to resume", hello.ID)
+	}
+	oldTargets, targets := old.Targets(), session.Targets()
+	if len(oldTargets) != len(targets) {
+		s.lock.Unlock()
+		return protocol.Reject(protocol.RejectCodeResumeFailed, "Session %d had %d forwards", hello.ID, len(oldTargets))
+	}
+	for _, target := range oldTargets {
+		if s.backends[target.Port] == nil {
+			s.lock.Unlock()
+			return protocol.Reject(protocol.RejectCodeResumeFailed, "Backend for port %d of session %d is gone", target.Port, hello.ID)
+		}
+	}
+	for i, target := range targets {
+		target.Port = oldTargets[i].Port
+		s.backends[target.Port].AddTarget(ctx, target)
+	}
+	s.sessions[hello.ID] = session
+	s.lock.Unlock()
+
+	// the old command connection may not have been noticed as dead yet
+	old.Close(ctx)
+	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Resumed session %d (%s) with %d forwards", session.ID, session.Identity, len(targets))
+	return nil
+}
+
+func (s *Server) removeSessionUnsafe(ctx context.Context, session *Session) {
+	if s.sessions[session.ID] == session {
+		delete(s.sessions, session.ID)
+	}
+	for _, target := range session.Targets() {
+		s.removeTargetUnsafe(ctx, target)
+	}
+}
+
+func (s *Server) removeTargetUnsafe(ctx context.Context, target *Target) {
+	log := logger.GetLogger(ctx)
+	backend := s.backends[target.Port]
+	if backend == nil || backend.RemoveTarget(ctx, target) > 0 {
+		return
+	}
+	grace := s.config.BackendGracePeriod
+	if grace <= 0 {
+		s.stopBackendUnsafe(ctx, backend)
+		return
+	}
+	logger.MaybeDebugfContext(ctx, log, "No targets left for port %d, stopping backend in %s", backend.Port(), grace)
+	time.AfterFunc(grace, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.backends[backend.Port()] == backend && backend.TargetCount() == 0 {
+			s.stopBackendUnsafe(ctx, backend)
+		}
+	})
+}
+
+func (s *Server) stopBackendUnsafe(ctx context.Context, backend *Backend) {
+	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Stopping backend for port %d", backend.Port())
+	delete(s.backends, backend.Port())
+	backend.Stop()
+}
+
+// ConnectTargetDataConn hands a data connection to the target that requested
+// it, writing the server hello to it first.
+func (s *Server) ConnectTargetDataConn(ctx context.Context, hello *protocol.ClientHello, identity *Identity, conn tcp.Conn, serverHello protocol.Frame) error {
+	s.lock.Lock()
 	backend := s.backends[hello.Port]
 	if backend == nil {
-		return fmt.Errorf("No existing backend")
+		s.lock.Unlock()
+		return protocol.Reject(protocol.RejectCodeNoBackend, "No existing backend on port %d", hello.Port)
+	}
+	if !backend.OwnedBy(identity) {
+		s.lock.Unlock()
+		return protocol.Reject(protocol.RejectCodeBackendOwnerMismatch, "Port %d is owned by another client", hello.Port)
 	}
-	if !backend.ValidSecret(hello.Secret) {
-		return fmt.Errorf("Invalid secret")
+	session := s.sessions[hello.ID]
+	s.lock.Unlock()
+	if session == nil {
+		return protocol.Reject(protocol.RejectCodeNoTarget, "No existing target %d", hello.ID)
 	}
-	target := s.targets[hello.ID]
-	if target == nil {
-		return fmt.Errorf("No existing target")
+	if session.Identity.Name != identity.Name {
+		return protocol.Reject(protocol.RejectCodeUnauthorized, "Target %d belongs to another client", hello.ID)
 	}
-	target.AddDataConn(ctx, conn)
-	return nil
+	return session.AddDataConn(ctx, hello.RequestID, conn, serverHello)
 }
 
 func (s *Server) listenAndCleanup(ctx context.Context, backend *Backend) error {
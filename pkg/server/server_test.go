@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+func TestAssignPort(t *testing.T) {
+	base := freePort(t)
+	ports := PortRange{Min: base, Max: base + 3}
+	// base+1 is held by another process and base+2 by another backend
+	held, err := net.Listen("tcp", fmt.Sprintf(":%d", base+1))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer held.Close()
+	taken := map[uint16]*Backend{base + 2: NewBackend("", base+2, "other", DefaultStrategy)}
+
+	for _, c := range []struct {
+		name     string
+		config   Config
+		identity *Identity
+		port     uint16
+		code     protocol.RejectCode
+	}{
+		{name: "no range", config: Config{}, identity: &Identity{}, code: protocol.RejectCodePortNotAllowed},
+		{name: "first free port", config: Config{AssignPorts: ports}, identity: &Identity{}, port: base},
+		{name: "skips the control port", config: Config{Port: base, AssignPorts: ports}, identity: &Identity{}, port: base + 3},
+		{name: "skips ports outside the policy", config: Config{AssignPorts: ports}, identity: &Identity{Policy: Policy{Ports: []PortRange{{Min: base + 1, Max: base + 3}}}}, port: base + 3},
+		{name: "exhausted", config: Config{AssignPorts: PortRange{Min: base + 1, Max: base + 2}}, identity: &Identity{}, code: protocol.RejectCodeNoPortAvailable},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := NewServer(c.config)
+			server.backends = taken
+			port, err := server.assignPortUnsafe("", c.identity)
+			if c.code != 0 {
+				var reject *protocol.RejectError
+				if !errors.As(err, &reject) || reject.Code != c.code {
+					t.Fatalf("got %d %v want code %s", port, err, c.code)
+				}
+				return
+			}
+			if err != nil || port != c.port {
+				t.Fatalf("got %d %v want %d", port, err, c.port)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/mux"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+type TargetState int
+
+const (
+	TargetStatePending TargetState = 0
+	TargetStateActive  TargetState = 1
+	TargetStateClosed  TargetState = 2
+)
+
+// Session is a client's command connection. It carries a target for each of
+// the client's forwards, which all share its heartbeat, streams and data
+// connection requests.
+type Session struct {
+	ID uint64
+
+	Version      uint16
+	Capabilities protocol.Capabilities
+	Identity     Identity
+
+	resumeToken []byte
+
+	lock    sync.Mutex
+	state   TargetState
+	ready   chan struct{}
+	done    chan struct{}
+	targets []*Target
+
+	cmdConn   *protocol.CmdConn
+	mux       *mux.Session
+	heartbeat *protocol.Heartbeat
+
+	pendingLock   sync.Mutex
+	nextRequestID uint64
+	pending       map[uint64]chan tcp.Conn
+}
+
+func NewSession(id uint64, cmdConn *protocol.CmdConn, capabilities protocol.Capabilities) *Session {
+	session := &Session{
+		ID:           id,
+		Capabilities: capabilities,
+		cmdConn:      cmdConn,
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
+		pending:      make(map[uint64]chan tcp.Conn),
+	}
+	if capabilities.Has(protocol.CapabilityMultiplex) {
+		session.mux = mux.NewSession(cmdConn, false)
+	}
+	return session
+}
+
+// AddTarget adds a target for the next of the client's forwards, targets are
+// kept in the order of the client hello.
+func (s *Session) AddTarget(forward protocol.Forward) *Target {
+	target := NewTarget(s, forward)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.targets = append(s.targets, target)
+	return target
+}
+
+func (s *Session) Targets() []*Target {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Target(nil), s.targets...)
+}
+
+// target returns the target for the port, or the first one for port zero as
+// sent by clients with a single forward.
+func (s *Session) target(port uint16) *Target {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, target := range s.targets {
+		if port == 0 || target.Port == port {
+			return target
+		}
+	}
+	return nil
+}
+
+// MarkReady is called once the handshake on the command connection is done,
+// nothing else may be sent on it before then.
+func (s *Session) MarkReady() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.state == TargetStatePending {
+		s.state = TargetStateActive
+	}
+	close(s.ready)
+}
+
+func (s *Session) State() TargetState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Done is closed once the session has been closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close shuts down the command connection and abandons any outstanding data
+// connection requests, their waiters close anything that still arrives.
+func (s *Session) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if s.state == TargetStateClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.state = TargetStateClosed
+	close(s.done)
+	targets := s.targets
+	s.lock.Unlock()
+
+	for _, target := range targets {
+		target.drainPool(ctx)
+	}
+
+	err := s.cmdConn.Close(ctx)
+	if s.mux != nil {
+		s.mux.Close(fmt.Errorf("Session closed"))
+	}
+	return err
+}
+
+func (s *Session) SetHeartbeat(heartbeat *protocol.Heartbeat) {
+	s.heartbeat = heartbeat
+}
+
+// RTT is the round trip time measured by the most recent heartbeat.
+func (s *Session) RTT() time.Duration {
+	if s.heartbeat == nil {
+		return 0
+	}
+	return s.heartbeat.RTT()
+}
+
+// Run reads from the command connection until it fails or is closed and then
+// closes the session.
+func (s *Session) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if s.heartbeat != nil {
+		go s.runHeartbeat(ctx)
+	}
+	for _, target := range s.Targets() {
+		if target.pool != nil {
+			go target.runPool(ctx)
+		}
+	}
+	err := s.readCommands(ctx)
+	if s.mux != nil {
+		s.mux.Close(err)
+	}
+	s.Close(ctx)
+	return err
+}
+
+func (s *Session) runHeartbeat(ctx context.Context) {
+	err := s.heartbeat.Run(ctx, s.cmdConn)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Session %d declared dead %s", s.ID, err.Error())
+	s.cmdConn.Close(ctx)
+}
+
+func (s *Session) readCommands(ctx context.Context) error {
+	log := logger.GetLogger(ctx)
+	for {
+		frame, err := s.cmdConn.ReadFrame(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case frame.Type == protocol.TypePing:
+			err = s.cmdConn.WriteFrame(ctx, protocol.Pong(frame))
+			if err != nil {
+				return err
+			}
+		case frame.Type == protocol.TypePong && s.heartbeat != nil:
+			err = s.heartbeat.HandlePong(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error handling pong from session %d %s", s.ID, err.Error())
+				continue
+			}
+			logger.MaybeDebugfContext(ctx, log, "Heartbeat from session %d rtt %s", s.ID, s.heartbeat.RTT())
+		case s.mux != nil && mux.IsStreamFrame(frame.Type):
+			err = s.mux.HandleFrame(ctx, frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error handling stream frame from session %d %s", s.ID, err.Error())
+			}
+		case frame.Type == protocol.TypeHealthReport:
+			report, err := protocol.ParseHealthReportFrame(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error handling health report from session %d %s", s.ID, err.Error())
+				continue
+			}
+			target := s.target(report.Port)
+			if target == nil {
+				logger.MaybeErrorfContext(ctx, log, "Health report from session %d for unknown port %d", s.ID, report.Port)
+				continue
+			}
+			target.setHealth(*report)
+			logger.MaybeInfofContext(ctx, log, "Target %d (%s) on port %d is %s", s.ID, s.Identity, target.Port, report)
+		default:
+			logger.MaybeErrorfContext(ctx, log, "Unknown message type %d from session %d", frame.Type, s.ID)
+		}
+	}
+}
+
+// AddDataConn writes the server hello to a new data connection and hands it to
+// the request waiting on it. Connections nobody is waiting for are rejected.
+func (s *Session) AddDataConn(ctx context.Context, requestID uint64, conn tcp.Conn, serverHello protocol.Frame) error {
+	s.pendingLock.Lock()
+	wait, has := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.pendingLock.Unlock()
+	if !has {
+		return protocol.Reject(protocol.RejectCodeNoPendingRequest, "No pending request %d for session %d", requestID, s.ID)
+	}
+	err := conn.Write(ctx, serverHello.Serialize())
+	if err != nil {
+		close(wait)
+		return err
+	}
+	wait <- conn
+	return nil
+}
+
+// OpenStream opens a stream to the client for the forward on the port.
+func (s *Session) OpenStream(ctx context.Context, port uint16) (tcp.Conn, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ready:
+	}
+	var meta []byte
+	if s.Capabilities.Has(protocol.CapabilityForwards) {
+		meta = binary.BigEndian.AppendUint16(nil, port)
+	}
+	stream, err := s.mux.OpenWith(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) requestDataConn(ctx context.Context, req protocol.DataConnRequest) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.ready:
+	}
+	if !s.Capabilities.Has(protocol.CapabilityForwards) {
+		req.Port = 0
+	}
+	return s.cmdConn.WriteFrame(ctx, req.Frame())
+}
+
+func (s *Session) WaitForConn(ctx context.Context, requestID uint64, wait chan tcp.Conn) (tcp.Conn, error) {
+	timeout := time.Second * 5
+	select {
+	case <-ctx.Done():
+		s.removePending(ctx, requestID, wait)
+		return nil, ctx.Err()
+	case <-time.After(timeout):
+		s.removePending(ctx, requestID, wait)
+		return nil, fmt.Errorf("Timeout trying to connect")
+	case <-s.done:
+		s.removePending(ctx, requestID, wait)
+		return nil, fmt.Errorf("Session closed")
+	case conn, ok := <-wait:
+		if !ok {
+			return nil, fmt.Errorf("Data connection for request %d failed", requestID)
+		}
+		return conn, nil
+	}
+}
+
+func (s *Session) addPending() (uint64, chan tcp.Conn) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.nextRequestID++
+	wait := make(chan tcp.Conn, 1)
+	s.pending[s.nextRequestID] = wait
+	return s.nextRequestID, wait
+}
+
+// removePending abandons a request. If a data connection has already claimed
+// it, wait for the handoff and close the connection.
+func (s *Session) removePending(ctx context.Context, requestID uint64, wait chan tcp.Conn) {
+	s.pendingLock.Lock()
+	_, has := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.pendingLock.Unlock()
+	if has {
+		return
+	}
+	conn, ok := <-wait
+	if ok {
+		conn.Close(ctx)
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	ctx := context.Background()
+	target, remote := newPipeTarget(1, 0)
+	defer remote.Close()
+	session := target.Session()
+	if session.State() != TargetStatePending {
+		t.Fatalf("state %d", session.State())
+	}
+	session.MarkReady()
+	if session.State() != TargetStateActive {
+		t.Fatalf("state %d", session.State())
+	}
+
+	session.Close(ctx)
+	select {
+	case <-session.Done():
+	default:
+		t.Fatal("done not closed")
+	}
+	if target.State() != TargetStateClosed {
+		t.Fatalf("state %d", target.State())
+	}
+	if _, err := target.GetConn(ctx); err == nil {
+		t.Fatal("got a connection from a closed target")
+	}
+	if session.Close(ctx) != nil {
+		t.Fatal("second close failed")
+	}
+}
+
+func TestDataConnPairing(t *testing.T) {
+	ctx := context.Background()
+	session, remote := newPipeSession(1, protocol.Forward{Port: 8000}, protocol.Forward{Port: 8001})
+	defer session.Close(ctx)
+	session.MarkReady()
+	target := session.Targets()[1]
+
+	type result struct {
+		conn tcp.Conn
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		conn, err := target.GetConn(ctx)
+		got <- result{conn, err}
+	}()
+	frame, err := protocol.NewFrameReader(remote).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := protocol.ParseDataConnRequestFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Port != target.Port {
+		t.Fatalf("request for port %d", req.Port)
+	}
+
+	for _, c := range []struct {
+		name      string
+		requestID uint64
+		ok        bool
+	}{
+		{name: "unknown request", requestID: req.RequestID + 1, ok: false},
+		{name: "pending request", requestID: req.RequestID, ok: true},
+		{name: "request already answered", requestID: req.RequestID, ok: false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			local, other := net.Pipe()
+			defer other.Close()
+			conn := &tcp.WrappedConn{Conn: local}
+			serverHello := protocol.ServerHello{Type: protocol.TypeServerHello, ID: session.ID, Proof: make([]byte, protocol.ProofLength)}
+			written := make(chan error, 1)
+			go func() {
+				_, err := protocol.ParseServerHello(other)
+				written <- err
+			}()
+			err := session.AddDataConn(ctx, c.requestID, conn, serverHello.Frame())
+			if (err == nil) != c.ok {
+				t.Fatalf("added %v want %v %v", err == nil, c.ok, err)
+			}
+			if !c.ok {
+				var reject *protocol.RejectError
+				if !errors.As(err, &reject) || reject.Code != protocol.RejectCodeNoPendingRequest {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+			r := <-got
+			if r.err != nil || r.conn == nil {
+				t.Fatalf("got %v %v", r.conn, r.err)
+			}
+			// the connection counts as active until it is closed
+			if target.ActiveConns() != 1 {
+				t.Fatalf("%d active connections", target.ActiveConns())
+			}
+			r.conn.Close(ctx)
+			if target.ActiveConns() != 0 {
+				t.Fatalf("%d active connections after close", target.ActiveConns())
+			}
+		})
+	}
+}
+
+func TestRegisterSession(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// forwards are built from two free ports, low below high, and the
+		// server's control port
+		forwards func(low, high, control uint16) []protocol.Forward
+		code     protocol.RejectCode
+	}{
+		{
+			name: "single forward",
+			forwards: func(low, high, control uint16) []protocol.Forward {
+				return []protocol.Forward{{Port: low}}
+			},
+		},
+		{
+			name: "several forwards",
+			forwards: func(low, high, control uint16) []protocol.Forward {
+				return []protocol.Forward{{Port: low}, {Port: high}}
+			},
+		},
+		{
+			name: "requested ports before assigned ones",
+			forwards: func(low, high, control uint16) []protocol.Forward {
+				return []protocol.Forward{{}, {Port: low}}
+			},
+		},
+		{
+			name: "duplicate port",
+			forwards: func(low, high, control uint16) []protocol.Forward {
+				return []protocol.Forward{{Port: low}, {Port: low}}
+			},
+			code: protocol.RejectCodeMalformedHello,
+		},
+		{
+			name: "rolls back on a rejected forward",
+			forwards: func(low, high, control uint16) []protocol.Forward {
+				return []protocol.Forward{{Port: low}, {Port: high}, {Port: control}}
+			},
+			code: protocol.RejectCodePortNotAllowed,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			low, high, control := freePort(t), freePort(t), freePort(t)
+			if low > high {
+				low, high = high, low
+			}
+			server := NewServer(Config{Port: control, AssignPorts: PortRange{Min: low, Max: high}})
+			forwards := c.forwards(low, high, control)
+			session, remote := newPipeSession(1, forwards...)
+			defer remote.Close()
+
+			err := server.RegisterSession(ctx, session, forwards)
+			if c.code != 0 {
+				var reject *protocol.RejectError
+				if !errors.As(err, &reject) || reject.Code != c.code {
+					t.Fatalf("got %v want code %s", err, c.code)
+				}
+				if len(server.backends) != 0 || len(server.sessions) != 0 {
+					t.Fatalf("left %d backends and %d sessions", len(server.backends), len(server.sessions))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server.sessions[session.ID] != session {
+				t.Fatal("session not registered")
+			}
+			seen := make(map[uint16]bool)
+			for i, target := range session.Targets() {
+				if target.Port == 0 || seen[target.Port] {
+					t.Fatalf("target %d on port %d", i, target.Port)
+				}
+				if forwards[i].Port != 0 && target.Port != forwards[i].Port {
+					t.Fatalf("target %d on port %d want %d", i, target.Port, forwards[i].Port)
+				}
+				seen[target.Port] = true
+				if server.backends[target.Port].TargetCount() != 1 {
+					t.Fatalf("no backend for port %d", target.Port)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveSessionStopsBackend(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		grace     time.Duration
+		reconnect bool
+		stopped   bool
+	}{
+		{name: "no grace period", grace: 0, stopped: true},
+		{name: "grace period expires", grace: 20 * time.Millisecond, stopped: true},
+		{name: "reconnect within grace period", grace: 200 * time.Millisecond, reconnect: true, stopped: false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server := NewServer(Config{BackendGracePeriod: c.grace})
+			forwards := []protocol.Forward{{Port: freePort(t)}}
+			session, remote := newPipeSession(1, forwards...)
+			defer remote.Close()
+			err := server.RegisterSession(ctx, session, forwards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend := server.backends[forwards[0].Port]
+
+			server.RemoveSession(ctx, session)
+			if c.reconnect {
+				next, remote := newPipeSession(2, forwards...)
+				defer remote.Close()
+				err = server.RegisterSession(ctx, next, forwards)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(c.grace + 50*time.Millisecond)
+
+			server.lock.Lock()
+			current := server.backends[forwards[0].Port]
+			server.lock.Unlock()
+			if stopped := current != backend; stopped != c.stopped {
+				t.Fatalf("stopped %v want %v", stopped, c.stopped)
+			}
+		})
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	token := bytes.Repeat([]byte{1}, protocol.ResumeTokenLength)
+	alice := Identity{Name: "alice"}
+	for _, c := range []struct {
+		name     string
+		window   time.Duration
+		wait     time.Duration
+		id       uint64
+		token    []byte
+		identity Identity
+		forwards int
+		ok       bool
+	}{
+		{name: "resumes", window: time.Second, id: 1, token: token, identity: alice, forwards: 2, ok: true},
+		{name: "unknown session", window: time.Second, id: 2, token: token, identity: alice, forwards: 2},
+		{name: "wrong token", window: time.Second, id: 1, token: bytes.Repeat([]byte{2}, protocol.ResumeTokenLength), identity: alice, forwards: 2},
+		{name: "another identity", window: time.Second, id: 1, token: token, identity: Identity{Name: "bob"}, forwards: 2},
+		{name: "different forwards", window: time.Second, id: 1, token: token, identity: alice, forwards: 1},
+		{name: "window expired", window: 20 * time.Millisecond, wait: 60 * time.Millisecond, id: 1, token: token, identity: alice, forwards: 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server := NewServer(Config{ResumeWindow: c.window})
+			forwards := []protocol.Forward{{Port: freePort(t)}, {Port: freePort(t)}}
+			old, remote := newPipeSession(1, forwards...)
+			defer remote.Close()
+			old.Identity = alice
+			old.resumeToken = token
+			err := server.RegisterSession(ctx, old, forwards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.RemoveSession(ctx, old)
+			time.Sleep(c.wait)
+
+			hello := &protocol.ClientHello{ID: c.id, ResumeToken: c.token}
+			next, remote := newPipeSession(c.id, make([]protocol.Forward, c.forwards)...)
+			defer remote.Close()
+			next.Identity = c.identity
+			err = server.ResumeSession(ctx, hello, next)
+			if !c.ok {
+				var reject *protocol.RejectError
+				if !errors.As(err, &reject) || reject.Code != protocol.RejectCodeResumeFailed {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, target := range next.Targets() {
+				if target.Port != forwards[i].Port {
+					t.Fatalf("forward %d resumed on port %d", i, target.Port)
+				}
+			}
+			if server.sessions[1] != next {
+				t.Fatal("session not replaced")
+			}
+			if old.State() != TargetStateClosed {
+				t.Fatal("old session still open")
+			}
+		})
+	}
+}
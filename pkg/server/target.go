@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blend/go-sdk/logger"
@@ -11,70 +12,246 @@ import (
 	"github.com/mat285/tcptunnel/pkg/tcp"
 )
 
+// Target is one of a session's forwards as a backend sees it.
 type Target struct {
-	ID    uint64
-	State uint64
+	ID uint64
 
-	cmdConn tcp.Conn
-	cmdBuf  []byte
+	Port     uint16
+	Weight   uint16
+	Priority uint16
 
-	queuelock sync.Mutex
-	queue     chan tcp.Conn
+	session *Session
+	active  int64
+
+	lock          sync.Mutex
+	health        protocol.HealthReport
+	pool          *tcp.Pool
+	poolMinIdle   int
+	poolMaxIdle   int
+	poolRequested int
+	poolRefill    chan struct{}
+}
+
+func NewTarget(session *Session, forward protocol.Forward) *Target {
+	return &Target{
+		ID:       session.ID,
+		Port:     forward.Port,
+		Weight:   forward.Weight,
+		Priority: forward.Priority,
+		session:  session,
+		health:   protocol.HealthReport{Healthy: true},
+	}
+}
+
+func (t *Target) Session() *Session {
+	return t.session
+}
+
+func (t *Target) Identity() Identity {
+	return t.session.Identity
+}
+
+func (t *Target) State() TargetState {
+	return t.session.State()
+}
+
+// SetPool keeps between minIdle and maxIdle data connections ready ahead of
+// time, the client must support CapabilityConnPool.
+func (t *Target) SetPool(minIdle, maxIdle int) {
+	t.pool = tcp.NewPool()
+	t.poolMinIdle = minIdle
+	t.poolMaxIdle = maxIdle
+	t.poolRefill = make(chan struct{}, 1)
+}
+
+// TargetStats is a snapshot of a connected target.
+type TargetStats struct {
+	ID       uint64
+	Identity string
+	Port     uint16
+	State    TargetState
+	RTT      time.Duration
+	Active   int64
+	Healthy  bool
+	// Idle is the number of pooled data connections ready for use
+	Idle int
+}
+
+func (t *Target) Stats() TargetStats {
+	return TargetStats{
+		ID:       t.ID,
+		Identity: t.session.Identity.String(),
+		Port:     t.Port,
+		State:    t.State(),
+		RTT:      t.session.RTT(),
+		Active:   t.ActiveConns(),
+		Healthy:  t.Healthy(),
+		Idle:     t.idle(),
+	}
 }
 
-func NewTarget(id uint64, cmdConn tcp.Conn) *Target {
-	target := &Target{
-		ID:      id,
-		cmdBuf:  make([]byte, 4096),
-		cmdConn: cmdConn,
-		queue:   make(chan tcp.Conn, 1024),
+func (t *Target) idle() int {
+	if t.pool == nil {
+		return 0
 	}
+	return t.pool.Free()
+}
+
+// Healthy reports whether the client's local service was up when it last
+// checked. Clients that do not check are always healthy.
+func (t *Target) Healthy() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.health.Healthy
+}
 
-	return target
+func (t *Target) setHealth(report protocol.HealthReport) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.health = report
 }
 
-func (t *Target) RequestCommand(ctx context.Context, req []byte) ([]byte, error) {
-	err := t.cmdConn.Write(ctx, req)
+// GetConn returns a new connection to the client, which counts as active
+// until it is closed.
+func (t *Target) GetConn(ctx context.Context) (tcp.Conn, error) {
+	conn, err := t.getConn(ctx)
 	if err != nil {
-		// terminate the conn
 		return nil, err
 	}
-	n, err := t.cmdConn.Read(ctx, t.cmdBuf)
+	atomic.AddInt64(&t.active, 1)
+	var once sync.Once
+	return tcp.OwnConn(conn, nil, func(ctx context.Context, _ tcp.Conn, err error) error {
+		once.Do(func() { atomic.AddInt64(&t.active, -1) })
+		return err
+	}), nil
+}
+
+func (t *Target) ActiveConns() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+func (t *Target) weight() int {
+	if t.Weight == 0 {
+		return 1
+	}
+	return int(t.Weight)
+}
+
+func (t *Target) getConn(ctx context.Context) (tcp.Conn, error) {
+	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Requesting connection from target %d on port %d", t.ID, t.Port)
+	if t.State() == TargetStateClosed {
+		return nil, fmt.Errorf("Target closed")
+	}
+	if t.session.mux != nil {
+		return t.session.OpenStream(ctx, t.Port)
+	}
+	if t.pool != nil {
+		defer t.refillPool()
+		conn := t.takePooled(ctx)
+		if conn != nil {
+			return conn, nil
+		}
+	}
+	requestID, wait := t.session.addPending()
+	err := t.session.requestDataConn(ctx, protocol.DataConnRequest{RequestID: requestID, Port: t.Port})
 	if err != nil {
+		t.session.removePending(ctx, requestID, wait)
 		return nil, err
 	}
-	return t.cmdBuf[:n], nil
+	return t.session.WaitForConn(ctx, requestID, wait)
 }
 
-func (t *Target) AddDataConn(ctx context.Context, conn tcp.Conn) error {
-	t.queuelock.Lock()
-	defer t.queuelock.Unlock()
-	if len(t.queue) == cap(t.queue) {
+// takePooled activates an idle pooled connection, or returns nil if there is
+// none.
+func (t *Target) takePooled(ctx context.Context) tcp.Conn {
+	activate := protocol.ActivateFrame()
+	for {
+		conn, err := t.pool.Aquire()
+		if err != nil {
+			return nil
+		}
+		t.pool.Remove(conn)
+		err = conn.Write(ctx, activate.Serialize())
+		if err == nil {
+			return conn
+		}
 		conn.Close(ctx)
-		return fmt.Errorf("max connections reached") // drop excess connections
 	}
-	t.queue <- conn
-	return nil
 }
 
-func (t *Target) GetConn(ctx context.Context) (tcp.Conn, error) {
-	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Requesting connection from target %d", t.ID)
-	err := t.cmdConn.Write(ctx, []byte{protocol.ClientHelloTypeData})
-	if err != nil {
-		return nil, err
+// runPool keeps the pool filled for as long as the session runs. Pooled
+// connections outlive the public connection that used up one, so they are
+// requested here with the session's context rather than by getConn.
+func (t *Target) runPool(ctx context.Context) {
+	for {
+		t.fillPool(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.poolRefill:
+		}
 	}
-	return t.WaitForConn(ctx)
 }
 
-func (t *Target) WaitForConn(ctx context.Context) (tcp.Conn, error) {
-	timeout := time.Second * 5
+func (t *Target) refillPool() {
 	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("Timeout trying to connect")
-	case conn := <-t.queue:
-		return conn, nil
+	case t.poolRefill <- struct{}{}:
+	default:
+	}
+}
 
+// fillPool requests enough pooled connections to bring the pool back up to
+// its minimum.
+func (t *Target) fillPool(ctx context.Context) {
+	if t.State() == TargetStateClosed {
+		return
+	}
+	t.lock.Lock()
+	missing := t.poolMinIdle - t.pool.Free() - t.poolRequested
+	if missing <= 0 {
+		t.lock.Unlock()
+		return
+	}
+	t.poolRequested += missing
+	t.lock.Unlock()
+	for i := 0; i < missing; i++ {
+		go t.requestPooledConn(ctx)
+	}
+}
+
+func (t *Target) requestPooledConn(ctx context.Context) {
+	defer func() {
+		t.lock.Lock()
+		t.poolRequested--
+		t.lock.Unlock()
+	}()
+	requestID, wait := t.session.addPending()
+	err := t.session.requestDataConn(ctx, protocol.DataConnRequest{RequestID: requestID, Pooled: true, Port: t.Port})
+	if err != nil {
+		t.session.removePending(ctx, requestID, wait)
+		return
+	}
+	conn, err := t.session.WaitForConn(ctx, requestID, wait)
+	if err != nil {
+		logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Error filling pool for target %d on port %d %s", t.ID, t.Port, err.Error())
+		return
+	}
+	// checked under the session lock so the connection is either refused
+	// here or drained when the session closes
+	t.session.lock.Lock()
+	defer t.session.lock.Unlock()
+	if t.session.state == TargetStateClosed || t.pool.Free() >= t.poolMaxIdle {
+		conn.Close(ctx)
+		return
+	}
+	t.pool.Add(conn)
+}
+
+func (t *Target) drainPool(ctx context.Context) {
+	if t.pool == nil {
+		return
+	}
+	for _, conn := range t.pool.Drain() {
+		conn.Close(ctx)
 	}
 }
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+	"github.com/mat285/tcptunnel/pkg/tcp"
+)
+
+func freePort(t *testing.T) uint16 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func newPipeSession(id uint64, forwards ...protocol.Forward) (*Session, net.Conn) {
+	local, remote := net.Pipe()
+	session := NewSession(id, protocol.NewCmdConn(local), protocol.CapabilityForwards)
+	for _, forward := range forwards {
+		session.AddTarget(forward)
+	}
+	return session, remote
+}
+
+func newPipeTarget(id uint64, port uint16) (*Target, net.Conn) {
+	session, remote := newPipeSession(id, protocol.Forward{Port: port})
+	return session.Targets()[0], remote
+}
+
+// answerPooled plays the client for the next pooled data connection request
+// and returns its end of the connection.
+func answerPooled(t *testing.T, target *Target, frames *protocol.FrameReader) net.Conn {
+	t.Helper()
+	frame, err := frames.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := protocol.ParseDataConnRequestFrame(frame)
+	if err != nil || !req.Pooled {
+		t.Fatalf("got %+v %v", req, err)
+	}
+	local, other := net.Pipe()
+	go protocol.ParseServerHello(other)
+	serverHello := protocol.ServerHello{Type: protocol.TypeServerHello, ID: target.ID}
+	err = target.Session().AddDataConn(context.Background(), req.RequestID, &tcp.WrappedConn{Conn: local}, serverHello.Frame())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return other
+}
+
+func TestDataConnPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target, remote := newPipeTarget(1, 0)
+	defer remote.Close()
+	target.SetPool(1, 1)
+	target.Session().MarkReady()
+	go target.Session().Run(ctx)
+	frames := protocol.NewFrameReader(remote)
+
+	first := answerPooled(t, target, frames)
+	defer first.Close()
+	deadline := time.Now().Add(time.Second)
+	for target.Stats().Idle != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("pooled connection never became idle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the pool is refilled after the public connection that took the idle
+	// one has gone away
+	connCtx, connCancel := context.WithCancel(ctx)
+	activated := make(chan error, 1)
+	go func() {
+		frame, err := protocol.NewFrameReader(first).ReadFrame()
+		if err == nil && frame.Type != protocol.TypeDataConnActivate {
+			err = fmt.Errorf("got message type %d", frame.Type)
+		}
+		activated <- err
+	}()
+	conn, err := target.GetConn(connCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-activated; err != nil {
+		t.Fatal(err)
+	}
+	conn.Close(connCtx)
+	connCancel()
+
+	second := answerPooled(t, target, frames)
+	defer second.Close()
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM bundle of CAs client certificates are verified
+	// against, client certificates are only requested when it is set
+	ClientCAFile string
+	// RequireClientCert rejects clients without a valid certificate, the
+	// shared secret is then optional
+	RequireClientCert bool
+}
+
+func (c TLSConfig) Enabled() bool {
+	return len(c.CertFile) > 0 || len(c.KeyFile) > 0
+}
+
+func (c TLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(c.ClientCAFile) > 0 {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.RequireClientCert {
+		return nil, fmt.Errorf("RequireClientCert needs a ClientCAFile")
+	}
+	return cfg, nil
+}
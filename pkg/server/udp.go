@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+// UDPOverflow is what a UDP port does with a datagram from a new source
+// address once it has as many sessions as it may.
+type UDPOverflow string
+
+const (
+	// UDPOverflowDrop drops datagrams from new sources until a session
+	// expires
+	UDPOverflowDrop UDPOverflow = "drop"
+	// UDPOverflowEvict forgets the least recently seen session to make room
+	UDPOverflowEvict UDPOverflow = "evict"
+)
+
+func ParseUDPOverflow(s string) (UDPOverflow, error) {
+	switch overflow := UDPOverflow(s); overflow {
+	case UDPOverflowDrop, UDPOverflowEvict:
+		return overflow, nil
+	case "":
+		return UDPOverflowDrop, nil
+	default:
+		return "", fmt.Errorf("Unknown UDP session overflow %s", s)
+	}
+}
+
+// UDPBackend listens for datagrams on a port and carries them over a single
+// client connection. Each source address is a session the client replies to,
+// sessions are forgotten once idle for the timeout.
+type UDPBackend struct {
+	host    string
+	port    uint16
+	owner   string
+	timeout time.Duration
+	// resumeToken lets the client take the port back from a connection the
+	// server has not noticed is dead
+	resumeToken []byte
+
+	conn      *net.UDPConn
+	client    *protocol.CmdConn
+	heartbeat *protocol.Heartbeat
+
+	lock        sync.Mutex
+	stopped     bool
+	nextID      uint32
+	sessions    map[string]*udpSession
+	ids         map[uint32]*udpSession
+	maxSessions int
+	overflow    UDPOverflow
+}
+
+type udpSession struct {
+	id       uint32
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+func NewUDPBackend(host string, port uint16, owner string, timeout time.Duration, client *protocol.CmdConn) *UDPBackend {
+	if timeout <= 0 {
+		timeout = protocol.DefaultUDPSessionTimeout
+	}
+	return &UDPBackend{
+		host:     host,
+		port:     port,
+		owner:    owner,
+		timeout:  timeout,
+		client:   client,
+		sessions: make(map[string]*udpSession),
+		ids:      make(map[uint32]*udpSession),
+	}
+}
+
+func (b *UDPBackend) Port() uint16 {
+	return b.port
+}
+
+func (b *UDPBackend) Host() string {
+	return b.host
+}
+
+func (b *UDPBackend) OwnedBy(identity *Identity) bool {
+	return b.owner == identity.Name
+}
+
+// Resumes reports whether the token is the one handed to the backend's
+// client.
+func (b *UDPBackend) Resumes(token []byte) bool {
+	return len(b.resumeToken) > 0 && hmac.Equal(b.resumeToken, token)
+}
+
+func (b *UDPBackend) Stopped() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stopped
+}
+
+func (b *UDPBackend) SetHeartbeat(heartbeat *protocol.Heartbeat) {
+	b.heartbeat = heartbeat
+}
+
+// SetSessionLimit caps the sessions the backend tracks at once, zero is no
+// limit.
+func (b *UDPBackend) SetSessionLimit(max int, overflow UDPOverflow) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.maxSessions = max
+	b.overflow = overflow
+}
+
+// Listen binds the port, it is separate from Run so a port that is taken is
+// reported before the client is told it has it.
+func (b *UDPBackend) Listen() error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(b.host, fmt.Sprintf("%d", b.port)))
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	return nil
+}
+
+// Run carries datagrams until the client connection fails or the backend is
+// stopped.
+func (b *UDPBackend) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer b.Stop()
+	if b.heartbeat != nil {
+		go b.runHeartbeat(ctx)
+	}
+	go b.expireSessions(ctx)
+	go b.readPublic(ctx)
+	return b.readClient(ctx)
+}
+
+func (b *UDPBackend) Stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopped {
+		return
+	}
+	b.stopped = true
+	b.conn.Close()
+	b.client.Close(context.Background())
+}
+
+// Sessions is the number of source addresses currently known.
+func (b *UDPBackend) Sessions() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.sessions)
+}
+
+func (b *UDPBackend) runHeartbeat(ctx context.Context) {
+	err := b.heartbeat.Run(ctx, b.client)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "UDP client for port %d declared dead %s", b.port, err.Error())
+	b.Stop()
+}
+
+// readPublic sends each datagram received on the port to the client under
+// the session of its source address.
+func (b *UDPBackend) readPublic(ctx context.Context) {
+	defer b.Stop()
+	buf := make([]byte, protocol.MaxDatagramLength)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		session, evicted := b.session(addr)
+		if evicted != nil {
+			err = b.client.WriteFrame(ctx, protocol.DatagramClose{Session: evicted.id}.Frame())
+			if err != nil {
+				return
+			}
+		}
+		if session == nil {
+			logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Dropping datagram from %s, port %d has %d sessions", addr, b.port, b.maxSessions)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		err = b.client.WriteFrame(ctx, protocol.Datagram{Session: session.id, Data: data}.Frame())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// session returns the session for the source address, starting one if it is
+// new. At the session limit it returns nil, or the session it evicted to make
+// room.
+func (b *UDPBackend) session(addr *net.UDPAddr) (*udpSession, *udpSession) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := addr.String()
+	session, has := b.sessions[key]
+	var evicted *udpSession
+	if !has && b.maxSessions > 0 && len(b.sessions) >= b.maxSessions {
+		if b.overflow != UDPOverflowEvict {
+			return nil, nil
+		}
+		for _, candidate := range b.sessions {
+			if evicted == nil || candidate.lastSeen.Before(evicted.lastSeen) {
+				evicted = candidate
+			}
+		}
+		delete(b.sessions, evicted.addr.String())
+		delete(b.ids, evicted.id)
+	}
+	if !has {
+		b.nextID++
+		for b.ids[b.nextID] != nil || b.nextID == 0 {
+			b.nextID++
+		}
+		session = &udpSession{id: b.nextID, addr: addr}
+		b.sessions[key] = session
+		b.ids[session.id] = session
+	}
+	session.lastSeen = time.Now()
+	return session, evicted
+}
+
+// readClient writes the client's replies to the source address of their
+// session.
+func (b *UDPBackend) readClient(ctx context.Context) error {
+	log := logger.GetLogger(ctx)
+	for {
+		frame, err := b.client.ReadFrame(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case frame.Type == protocol.TypeDatagram:
+			datagram, err := protocol.ParseDatagramFrame(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error handling datagram for port %d %s", b.port, err.Error())
+				continue
+			}
+			b.lock.Lock()
+			session := b.ids[datagram.Session]
+			if session != nil {
+				session.lastSeen = time.Now()
+			}
+			b.lock.Unlock()
+			if session == nil {
+				// the session expired while the reply was on its way
+				continue
+			}
+			_, err = b.conn.WriteToUDP(datagram.Data, session.addr)
+			if err != nil {
+				logger.MaybeDebugfContext(ctx, log, "Error writing datagram to %s on port %d %s", session.addr, b.port, err.Error())
+			}
+		case frame.Type == protocol.TypePing:
+			err = b.client.WriteFrame(ctx, protocol.Pong(frame))
+			if err != nil {
+				return err
+			}
+		case frame.Type == protocol.TypePong && b.heartbeat != nil:
+			err = b.heartbeat.HandlePong(frame)
+			if err != nil {
+				logger.MaybeErrorfContext(ctx, log, "Error handling pong from UDP client for port %d %s", b.port, err.Error())
+			}
+		default:
+			logger.MaybeErrorfContext(ctx, log, "Unknown message type %d from UDP client for port %d", frame.Type, b.port)
+		}
+	}
+}
+
+// expireSessions forgets sessions idle for longer than the timeout and tells
+// the client so it can release their local sockets.
+func (b *UDPBackend) expireSessions(ctx context.Context) {
+	interval := b.timeout / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var expired []uint32
+		now := time.Now()
+		b.lock.Lock()
+		for key, session := range b.sessions {
+			if now.Sub(session.lastSeen) >= b.timeout {
+				delete(b.sessions, key)
+				delete(b.ids, session.id)
+				expired = append(expired, session.id)
+			}
+		}
+		b.lock.Unlock()
+		for _, id := range expired {
+			err := b.client.WriteFrame(ctx, protocol.DatagramClose{Session: id}.Frame())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// RegisterUDP binds a UDP backend for the client's port. The port stays with
+// the connection holding it while that is alive, as clients sharing an
+// identity cannot otherwise be told apart, unless the newcomer presents the
+// resume token handed to it. The new backend is given resumeToken.
+func (s *Server) RegisterUDP(ctx context.Context, identity *Identity, hello *protocol.ClientHello, resumeToken []byte, client *protocol.CmdConn) (*UDPBackend, error) {
+	forward := hello.AllForwards()[0]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !identity.Policy.AllowsBind(forward.BindHost) {
+		return nil, protocol.Reject(protocol.RejectCodeBindNotAllowed, "%s may not listen on %s", identity, forward.BindHost)
+	}
+	if forward.Port == 0 {
+		return nil, protocol.Reject(protocol.RejectCodePortNotAllowed, "UDP forwards need a port")
+	}
+	if forward.Port == s.config.Port || !identity.Policy.AllowsPort(forward.Port) {
+		return nil, protocol.Reject(protocol.RejectCodePortNotAllowed, "%s may not claim port %d", identity, forward.Port)
+	}
+	existing := s.udpBackends[forward.Port]
+	if existing != nil && !existing.OwnedBy(identity) {
+		return nil, protocol.Reject(protocol.RejectCodeBackendOwnerMismatch, "UDP port %d is owned by another client", forward.Port)
+	}
+	if existing == nil && !identity.Policy.AllowsBackends(s.ownedBackendsUnsafe(identity)+1) {
+		return nil, protocol.Reject(protocol.RejectCodeBackendLimit, "%s may hold at most %d ports", identity, identity.Policy.MaxBackends)
+	}
+	if existing != nil && !existing.Stopped() && !existing.Resumes(hello.ResumeToken) {
+		return nil, protocol.Reject(protocol.RejectCodePortInUse, "UDP port %d is held by another connection", forward.Port)
+	}
+	if existing != nil {
+		logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Replacing UDP client for port %d (%s)", forward.Port, identity)
+		existing.Stop()
+		delete(s.udpBackends, forward.Port)
+	}
+	backend := NewUDPBackend(s.bindHost(forward), forward.Port, identity.Name, s.config.UDPSessionTimeout, client)
+	backend.resumeToken = resumeToken
+	backend.SetSessionLimit(s.config.UDPMaxSessions, s.config.UDPSessionOverflow)
+	err := backend.Listen()
+	if err != nil {
+		return nil, protocol.Reject(protocol.RejectCodePortInUse, "%s", err.Error())
+	}
+	s.udpBackends[forward.Port] = backend
+	return backend, nil
+}
+
+// RemoveUDP stops the backend and forgets it unless it was already replaced.
+func (s *Server) RemoveUDP(ctx context.Context, backend *UDPBackend) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	backend.Stop()
+	if s.udpBackends[backend.Port()] == backend {
+		delete(s.udpBackends, backend.Port())
+	}
+}
+
+func (s *Server) runUDP(ctx context.Context, backend *UDPBackend) {
+	err := backend.Run(ctx)
+	if err != nil {
+		logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "UDP client for port %d disconnected %s", backend.Port(), err.Error())
+	}
+	s.RemoveUDP(ctx, backend)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mat285/tcptunnel/pkg/protocol"
+)
+
+func freeUDPPort(t *testing.T) uint16 {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func udpClient(t *testing.T) *protocol.CmdConn {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	return protocol.NewCmdConn(conn)
+}
+
+func TestRegisterUDPKeepsLiveClient(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(Config{BackendBindHost: "127.0.0.1"})
+	identity := &Identity{}
+	hello := &protocol.ClientHello{Type: protocol.ClientHelloTypeUDP, Port: freeUDPPort(t)}
+	token := []byte("first client token")
+	first, err := s.RegisterUDP(ctx, identity, hello, token, udpClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+
+	_, err = s.RegisterUDP(ctx, identity, hello, nil, udpClient(t))
+	var reject *protocol.RejectError
+	if !errors.As(err, &reject) || reject.Code != protocol.RejectCodePortInUse {
+		t.Fatalf("got %v", err)
+	}
+	if first.Stopped() {
+		t.Fatal("live client was replaced")
+	}
+
+	resumed := *hello
+	resumed.ResumeToken = token
+	second, err := s.RegisterUDP(ctx, identity, &resumed, nil, udpClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Stop()
+	if !first.Stopped() {
+		t.Fatal("resumed client did not replace its old connection")
+	}
+
+	second.Stop()
+	third, err := s.RegisterUDP(ctx, identity, hello, nil, udpClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.Stop()
+}
+
+func TestUDPSessionLimit(t *testing.T) {
+	// each step sends a datagram from one of the sources and expects the
+	// frames that follow it, a datagram for a session or the close of one
+	type frame struct {
+		close   bool
+		session uint32
+	}
+	type step struct {
+		source int
+		// wait lets the sessions expire before sending
+		wait   bool
+		frames []frame
+	}
+	for _, c := range []struct {
+		name     string
+		max      int
+		overflow UDPOverflow
+		steps    []step
+	}{
+		{
+			name: "unlimited",
+			steps: []step{
+				{source: 0, frames: []frame{{session: 1}}},
+				{source: 1, frames: []frame{{session: 2}}},
+				{source: 2, frames: []frame{{session: 3}}},
+			},
+		},
+		{
+			name:     "drops new sources until sessions expire",
+			max:      2,
+			overflow: UDPOverflowDrop,
+			steps: []step{
+				{source: 0, frames: []frame{{session: 1}}},
+				{source: 1, frames: []frame{{session: 2}}},
+				// dropped, the next frame is the datagram that follows
+				{source: 2},
+				{source: 1, frames: []frame{{session: 2}}},
+				{source: 2, wait: true, frames: []frame{{session: 3}}},
+			},
+		},
+		{
+			name:     "evicts the least recently seen session",
+			max:      2,
+			overflow: UDPOverflowEvict,
+			steps: []step{
+				{source: 0, frames: []frame{{session: 1}}},
+				{source: 1, frames: []frame{{session: 2}}},
+				{source: 0, frames: []frame{{session: 1}}},
+				{source: 2, frames: []frame{{close: true, session: 2}, {session: 3}}},
+				{source: 1, wait: true, frames: []frame{{session: 4}}},
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			timeout := 300 * time.Millisecond
+			backend := NewUDPBackend("127.0.0.1", freeUDPPort(t), "", timeout, protocol.NewCmdConn(conn))
+			backend.SetSessionLimit(c.max, c.overflow)
+			if err := backend.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			go backend.Run(ctx)
+
+			// expired sessions are closed in the background, only the
+			// frames the steps expect are passed on
+			frames := make(chan frame, 16)
+			go func() {
+				reader := protocol.NewFrameReader(peer)
+				for {
+					f, err := reader.ReadFrame()
+					if err != nil {
+						close(frames)
+						return
+					}
+					if f.Type == protocol.TypeDatagramClose {
+						closed, _ := protocol.ParseDatagramCloseFrame(f)
+						frames <- frame{close: true, session: closed.Session}
+						continue
+					}
+					datagram, _ := protocol.ParseDatagramFrame(f)
+					frames <- frame{session: datagram.Session}
+				}
+			}()
+
+			addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(backend.Port())}
+			sources := make([]*net.UDPConn, 3)
+			for i := range sources {
+				source, err := net.DialUDP("udp", nil, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer source.Close()
+				sources[i] = source
+			}
+			for i, step := range c.steps {
+				if step.wait {
+					deadline := time.Now().Add(10 * timeout)
+					for backend.Sessions() > 0 {
+						if time.Now().After(deadline) {
+							t.Fatalf("step %d: %d sessions never expired", i, backend.Sessions())
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}
+				if _, err := sources[step.source].Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				for j := 0; j < len(step.frames); {
+					select {
+					case got := <-frames:
+						// closes of the expired sessions may still be on
+						// their way
+						if step.wait && got.close {
+							continue
+						}
+						if got != step.frames[j] {
+							t.Fatalf("step %d: got %+v want %+v", i, got, step.frames[j])
+						}
+						j++
+					case <-time.After(time.Second):
+						t.Fatalf("step %d: no frame", i)
+					}
+				}
+			}
+			if c.max > 0 && backend.Sessions() > c.max {
+				t.Fatalf("%d sessions over the limit of %d", backend.Sessions(), c.max)
+			}
+		})
+	}
+}
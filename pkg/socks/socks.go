@@ -0,0 +1,182 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 as in RFC 1928, with username/password authentication from RFC 1929.
+// Only CONNECT is supported.
+const (
+	version     = 5
+	authVersion = 1
+
+	methodNoAuth       = 0
+	methodPassword     = 2
+	methodNoAcceptable = 0xff
+
+	commandConnect = 1
+
+	addressIPv4   = 1
+	addressDomain = 3
+	addressIPv6   = 4
+)
+
+// ReplyCode is sent to the SOCKS client once its request is handled.
+type ReplyCode byte
+
+const (
+	ReplySucceeded           ReplyCode = 0
+	ReplyGeneralFailure      ReplyCode = 1
+	ReplyNotAllowed          ReplyCode = 2
+	ReplyHostUnreachable     ReplyCode = 4
+	ReplyConnectionRefused   ReplyCode = 5
+	ReplyCommandNotSupported ReplyCode = 7
+	ReplyAddressNotSupported ReplyCode = 8
+)
+
+// Credentials are required from SOCKS clients when set.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Handshake negotiates authentication with a SOCKS client and reads its
+// request, returning the host:port it wants to connect to. Requests that
+// cannot be served are replied to before the error is returned.
+func Handshake(conn net.Conn, credentials *Credentials) (string, error) {
+	err := negotiate(conn, credentials)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != version {
+		return "", fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	host, err := readAddress(conn, header[3])
+	if err != nil {
+		Reply(conn, ReplyAddressNotSupported)
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", err
+	}
+	if header[1] != commandConnect {
+		Reply(conn, ReplyCommandNotSupported)
+		return "", fmt.Errorf("Unsupported SOCKS command %d", header[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Reply answers the SOCKS client's request, the bound address is always
+// reported as unspecified.
+func Reply(conn net.Conn, code ReplyCode) error {
+	_, err := conn.Write([]byte{version, byte(code), 0, addressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func negotiate(conn net.Conn, credentials *Credentials) error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != version {
+		return fmt.Errorf("Unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+	want := byte(methodNoAuth)
+	if credentials != nil {
+		want = methodPassword
+	}
+	for _, method := range methods {
+		if method == want {
+			_, err = conn.Write([]byte{version, want})
+			if err != nil {
+				return err
+			}
+			if credentials != nil {
+				return authenticate(conn, credentials)
+			}
+			return nil
+		}
+	}
+	conn.Write([]byte{version, methodNoAcceptable})
+	return fmt.Errorf("No acceptable SOCKS authentication method")
+}
+
+func authenticate(conn net.Conn, credentials *Credentials) error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[0] != authVersion {
+		return fmt.Errorf("Unsupported SOCKS authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 1)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+	usernameOK := subtle.ConstantTimeCompare(username, []byte(credentials.Username))
+	passwordOK := subtle.ConstantTimeCompare(password, []byte(credentials.Password))
+	if usernameOK&passwordOK != 1 {
+		conn.Write([]byte{authVersion, 1})
+		return fmt.Errorf("Wrong SOCKS username or password")
+	}
+	_, err = conn.Write([]byte{authVersion, 0})
+	return err
+}
+
+func readAddress(conn net.Conn, t byte) (string, error) {
+	var length int
+	switch t {
+	case addressIPv4:
+		length = net.IPv4len
+	case addressIPv6:
+		length = net.IPv6len
+	case addressDomain:
+		b := make([]byte, 1)
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		length = int(b[0])
+	default:
+		return "", fmt.Errorf("Unsupported SOCKS address type %d", t)
+	}
+	addr := make([]byte, length)
+	_, err := io.ReadFull(conn, addr)
+	if err != nil {
+		return "", err
+	}
+	if t == addressDomain {
+		return string(addr), nil
+	}
+	return net.IP(addr).String(), nil
+}
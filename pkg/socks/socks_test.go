@@ -0,0 +1,120 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// handshake runs Handshake against a client that sends request, returning
+// what the server wrote back.
+func handshake(t *testing.T, credentials *Credentials, request []byte) (string, []byte, error) {
+	t.Helper()
+	server, client := net.Pipe()
+	replies := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, client)
+		replies <- buf.Bytes()
+	}()
+	go client.Write(request)
+	target, err := Handshake(server, credentials)
+	server.Close()
+	return target, <-replies, err
+}
+
+func connect(addressType byte, address ...byte) []byte {
+	return append([]byte{version, commandConnect, 0, addressType}, address...)
+}
+
+func TestHandshakeDomain(t *testing.T) {
+	request := []byte{version, 1, methodNoAuth}
+	request = append(request, connect(addressDomain, append([]byte{11}, "example.com"...)...)...)
+	request = append(request, 0x01, 0xbb)
+	target, replies, err := handshake(t, nil, request)
+	if err != nil || target != "example.com:443" {
+		t.Fatalf("got %s %v", target, err)
+	}
+	if !bytes.Equal(replies, []byte{version, methodNoAuth}) {
+		t.Fatalf("replied %v", replies)
+	}
+}
+
+func TestHandshakeIP(t *testing.T) {
+	ipv4 := []byte{version, 1, methodNoAuth}
+	ipv4 = append(ipv4, connect(addressIPv4, 127, 0, 0, 1, 0, 80)...)
+	target, _, err := handshake(t, nil, ipv4)
+	if err != nil || target != "127.0.0.1:80" {
+		t.Fatalf("got %s %v", target, err)
+	}
+
+	ipv6 := []byte{version, 1, methodNoAuth}
+	ipv6 = append(ipv6, connect(addressIPv6, append([]byte(net.ParseIP("::1")), 0, 22)...)...)
+	target, _, err = handshake(t, nil, ipv6)
+	if err != nil || target != "[::1]:22" {
+		t.Fatalf("got %s %v", target, err)
+	}
+}
+
+func TestHandshakePassword(t *testing.T) {
+	credentials := &Credentials{Username: "user", Password: "secret"}
+	request := []byte{version, 2, methodNoAuth, methodPassword}
+	request = append(request, authVersion, 4)
+	request = append(request, "user"...)
+	request = append(request, 6)
+	request = append(request, "secret"...)
+	request = append(request, connect(addressIPv4, 10, 0, 0, 1, 0x1f, 0x90)...)
+	target, replies, err := handshake(t, credentials, request)
+	if err != nil || target != "10.0.0.1:8080" {
+		t.Fatalf("got %s %v", target, err)
+	}
+	if !bytes.Equal(replies, []byte{version, methodPassword, authVersion, 0}) {
+		t.Fatalf("replied %v", replies)
+	}
+}
+
+func TestHandshakeWrongPassword(t *testing.T) {
+	credentials := &Credentials{Username: "user", Password: "secret"}
+	request := []byte{version, 1, methodPassword, authVersion, 4}
+	request = append(request, "user"...)
+	request = append(request, 5)
+	request = append(request, "wrong"...)
+	_, replies, err := handshake(t, credentials, request)
+	if err == nil {
+		t.Fatal("accepted a wrong password")
+	}
+	if !bytes.Equal(replies, []byte{version, methodPassword, authVersion, 1}) {
+		t.Fatalf("replied %v", replies)
+	}
+}
+
+func TestHandshakeNoAcceptableMethod(t *testing.T) {
+	_, replies, err := handshake(t, &Credentials{Username: "user"}, []byte{version, 1, methodNoAuth})
+	if err == nil {
+		t.Fatal("accepted a client without credentials")
+	}
+	if !bytes.Equal(replies, []byte{version, methodNoAcceptable}) {
+		t.Fatalf("replied %v", replies)
+	}
+}
+
+func TestHandshakeUnsupported(t *testing.T) {
+	bind := []byte{version, 1, methodNoAuth, version, 2, 0, addressIPv4, 127, 0, 0, 1, 0, 80}
+	_, replies, err := handshake(t, nil, bind)
+	if err == nil || ReplyCode(replies[3]) != ReplyCommandNotSupported {
+		t.Fatalf("replied %v %v", replies, err)
+	}
+
+	unknown := []byte{version, 1, methodNoAuth}
+	unknown = append(unknown, connect(9, 0, 0)...)
+	_, replies, err = handshake(t, nil, unknown)
+	if err == nil || ReplyCode(replies[3]) != ReplyAddressNotSupported {
+		t.Fatalf("replied %v %v", replies, err)
+	}
+
+	_, _, err = handshake(t, nil, []byte{4, 1, 0, 80})
+	if err == nil {
+		t.Fatal("accepted SOCKS4")
+	}
+}
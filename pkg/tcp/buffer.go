@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultBufferSize is what tunnels copy through when the kernel cannot do
+// the copy for them.
+const DefaultBufferSize = 32 * 1024
+
+// BufferPool reuses the buffers of finished tunnels.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool hands out buffers of the size, DefaultBufferSize if it is not
+// positive.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+func (p *BufferPool) Size() int {
+	return p.size
+}
+
+func (p *BufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *BufferPool) Put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+var defaultBufferPool = NewBufferPool(DefaultBufferSize)
+
+type bufferPoolKey struct{}
+
+// WithBufferPool makes tunnels run with the context use the pool.
+func WithBufferPool(ctx context.Context, pool *BufferPool) context.Context {
+	return context.WithValue(ctx, bufferPoolKey{}, pool)
+}
+
+// GetBufferPool returns the context's pool, or a shared one of
+// DefaultBufferSize.
+func GetBufferPool(ctx context.Context) *BufferPool {
+	pool, ok := ctx.Value(bufferPoolKey{}).(*BufferPool)
+	if !ok || pool == nil {
+		return defaultBufferPool
+	}
+	return pool
+}
@@ -31,6 +31,14 @@ func (c *TCPClient) Close(ctx context.Context) error {
 	return c.conn.Close()
 }
 
+func (c *TCPClient) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *TCPClient) CloseWrite(ctx context.Context) error {
+	return closeWrite(c.conn)
+}
+
 func (c *TCPClient) State() ConnState {
 	return c.state
 }
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"fmt"
 	"net"
 )
 
@@ -17,6 +18,9 @@ type Conn interface {
 	Write(context.Context, []byte) error
 	Read(context.Context, []byte) (int, error)
 	Close(context.Context) error
+	// CloseWrite tells the peer we are done writing, reading continues until
+	// the peer is done too
+	CloseWrite(context.Context) error
 	State() ConnState
 }
 
@@ -52,6 +56,23 @@ func (oc *OwnedConn) Read(ctx context.Context, buf []byte) (int, error) {
 	return n, err
 }
 
+// NetConn returns the connection underneath when it is a plain net.Conn, nil
+// if there is none or OnError must see every error.
+func (oc *OwnedConn) NetConn() net.Conn {
+	if oc.OnError != nil {
+		return nil
+	}
+	return netConn(oc.Conn)
+}
+
+func (oc *OwnedConn) CloseWrite(ctx context.Context) error {
+	err := oc.Conn.CloseWrite(ctx)
+	if oc.OnError != nil {
+		err = oc.OnError(ctx, oc.Conn, err)
+	}
+	return err
+}
+
 func (oc *OwnedConn) Close(ctx context.Context) error {
 	err := oc.Conn.Close(ctx)
 	if oc.Closer == nil {
@@ -89,6 +110,34 @@ func (w WrappedConn) Close(ctx context.Context) error {
 	return w.Conn.Close()
 }
 
+func (w WrappedConn) NetConn() net.Conn {
+	return w.Conn
+}
+
+func (w WrappedConn) CloseWrite(ctx context.Context) error {
+	return closeWrite(w.Conn)
+}
+
 func (w WrappedConn) State() ConnState {
 	return w.state
 }
+
+// netConn returns the net.Conn a Conn wraps, or nil if it is something else
+// such as a multiplexed stream.
+func netConn(conn Conn) net.Conn {
+	wrapper, ok := conn.(interface{ NetConn() net.Conn })
+	if !ok {
+		return nil
+	}
+	return wrapper.NetConn()
+}
+
+// closeWrite half-closes connections that support it, such as TCP, Unix and
+// TLS connections.
+func closeWrite(conn net.Conn) error {
+	closer, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("%T does not support half-close", conn)
+	}
+	return closer.CloseWrite()
+}
@@ -0,0 +1,29 @@
+package tcp
+
+import (
+	"context"
+	"net"
+)
+
+// ConnMeta describes the accepted connection a ConnProvider is asked to
+// provide the other end of a tunnel for.
+type ConnMeta struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+}
+
+type connMetaKey struct{}
+
+func WithConnMeta(ctx context.Context, meta ConnMeta) context.Context {
+	return context.WithValue(ctx, connMetaKey{}, meta)
+}
+
+func GetConnMeta(ctx context.Context) *ConnMeta {
+	raw := ctx.Value(connMetaKey{})
+	meta, ok := raw.(ConnMeta)
+	if !ok {
+		return nil
+	}
+
+	return &meta
+}
@@ -0,0 +1,191 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixPrefix marks an address as the path of a Unix domain socket.
+const UnixPrefix = "unix:"
+
+// ErrDestinationNotAllowed is wrapped by Dial's error when the rules refused
+// the address.
+var ErrDestinationNotAllowed = errors.New("Destination not allowed")
+
+// SplitNetwork splits a host:port or unix:/path address into the network and
+// address to dial.
+func SplitNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, UnixPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixPrefix)
+	}
+	return "tcp", address
+}
+
+// ValidateAddress checks that the address is a host:port or unix:/path.
+func ValidateAddress(address string) error {
+	network, addr := SplitNetwork(address)
+	if network == "unix" {
+		if len(addr) == 0 {
+			return fmt.Errorf("Missing socket path in %s", address)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if len(host) == 0 || len(port) == 0 {
+		return fmt.Errorf("Address %s needs a host and a port", address)
+	}
+	return nil
+}
+
+// ResolvedAtDial reports whether the address names a host that is only
+// resolved when it is dialed, any other address is fixed.
+func ResolvedAtDial(address string) bool {
+	network, addr := SplitNetwork(address)
+	if network == "unix" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && net.ParseIP(host) == nil
+}
+
+// Rules decide which addresses Dial may connect to. An address is allowed
+// if every non-nil Allow list matches it and no Deny list does. Lists match
+// hostnames by name, so deny IP ranges rather than names.
+type Rules struct {
+	Allow []AddressList
+	Deny  []AddressList
+}
+
+func (r Rules) Allows(network, address, resolved string) bool {
+	for _, list := range r.Allow {
+		if list != nil && !list.Matches(network, address, resolved) {
+			return false
+		}
+	}
+	for _, list := range r.Deny {
+		if list.Matches(network, address, resolved) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsFixed reports whether the rules allow the address if it is fixed,
+// hostnames are left to be checked when they are dialed.
+func (r Rules) AllowsFixed(address string) bool {
+	if ResolvedAtDial(address) {
+		return true
+	}
+	network, addr := SplitNetwork(address)
+	return r.Allows(network, addr, addr)
+}
+
+// Dial dials a host:port or unix:/path address, resolving any hostname now so
+// changes to it are picked up. The rules are checked against the address
+// actually dialed.
+func Dial(ctx context.Context, address string, timeout time.Duration, rules Rules) (net.Conn, error) {
+	network, addr := SplitNetwork(address)
+	return dial(ctx, network, addr, timeout, rules)
+}
+
+// DialUDP connects a UDP socket to a host:port under the rules, like Dial.
+func DialUDP(ctx context.Context, address string, timeout time.Duration, rules Rules) (net.Conn, error) {
+	return dial(ctx, "udp", address, timeout, rules)
+}
+
+func dial(ctx context.Context, network, addr string, timeout time.Duration, rules Rules) (net.Conn, error) {
+	address := addr
+	if network == "unix" {
+		address = UnixPrefix + addr
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	dialer.Control = func(_, resolved string, _ syscall.RawConn) error {
+		if !rules.Allows(network, addr, resolved) {
+			return fmt.Errorf("%w %s", ErrDestinationNotAllowed, address)
+		}
+		return nil
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// AddressList matches addresses against entries that are either unix:<glob>
+// for socket paths or <host>:<port>, where host is a hostname, IP or CIDR
+// range and port may be *.
+type AddressList []addressEntry
+
+type addressEntry struct {
+	unix    string
+	host    string
+	network *net.IPNet
+	port    string
+}
+
+// ParseAddressList returns nil for no entries.
+func ParseAddressList(entries []string) (AddressList, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	list := make(AddressList, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, UnixPrefix) {
+			pattern := strings.TrimPrefix(entry, UnixPrefix)
+			if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+				return nil, fmt.Errorf("Invalid destination rule %s", entry)
+			}
+			list = append(list, addressEntry{unix: pattern})
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid destination rule %s %s", entry, err.Error())
+		}
+		matched := addressEntry{host: host, port: port}
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			matched.network = network
+		} else if ip := net.ParseIP(host); ip != nil {
+			matched.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		list = append(list, matched)
+	}
+	return list, nil
+}
+
+// Matches reports whether an entry matches the address by name or the
+// resolved address by IP.
+func (l AddressList) Matches(network, address, resolved string) bool {
+	if network == "unix" {
+		for _, entry := range l {
+			if matched, _ := path.Match(entry.unix, address); len(entry.unix) > 0 && matched {
+				return true
+			}
+		}
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	resolvedHost, _, err := net.SplitHostPort(resolved)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(resolvedHost)
+	for _, entry := range l {
+		if len(entry.unix) > 0 || (entry.port != "*" && entry.port != port) {
+			continue
+		}
+		if strings.EqualFold(entry.host, host) || (entry.network != nil && ip != nil && entry.network.Contains(ip)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package tcp
+
+import "testing"
+
+func TestAddressList(t *testing.T) {
+	list, err := ParseAddressList([]string{"unix:/run/app/*.sock", "10.0.0.0/8:*", "db.internal:5432", "[::1]:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		address  string
+		resolved string
+		match    bool
+	}{
+		{name: "socket matching the glob", address: "unix:/run/app/web.sock", match: true},
+		{name: "socket outside the glob", address: "unix:/run/other.sock"},
+		{name: "ip in range", address: "10.1.2.3:8080", resolved: "10.1.2.3:8080", match: true},
+		{name: "ip outside range", address: "192.168.0.1:8080", resolved: "192.168.0.1:8080"},
+		{name: "hostname by name", address: "db.internal:5432", resolved: "172.16.0.4:5432", match: true},
+		{name: "hostname on another port", address: "db.internal:5433", resolved: "172.16.0.4:5433"},
+		{name: "hostname resolving into range", address: "cache.internal:6379", resolved: "10.0.0.9:6379", match: true},
+		{name: "hostname resolving elsewhere", address: "cache.internal:6379", resolved: "172.16.0.9:6379"},
+		{name: "ipv6 host", address: "[::1]:80", resolved: "[::1]:80", match: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			network, address := SplitNetwork(c.address)
+			if list.Matches(network, address, c.resolved) != c.match {
+				t.Fatalf("matched %v want %v", !c.match, c.match)
+			}
+		})
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	for _, entries := range [][]string{{"unix:"}, {"unix:[a"}, {"10.0.0.1"}, {"127.0.0.1:80", "nohost"}} {
+		if _, err := ParseAddressList(entries); err == nil {
+			t.Fatalf("parsed %v", entries)
+		}
+	}
+	list, err := ParseAddressList(nil)
+	if list != nil || err != nil {
+		t.Fatalf("got %v %v", list, err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	server, _ := ParseAddressList([]string{"10.0.0.0/8:*", "example.com:443"})
+	policy, _ := ParseAddressList([]string{"10.1.0.0/16:*"})
+	deny, _ := ParseAddressList([]string{"10.1.2.0/24:*"})
+	for _, c := range []struct {
+		name     string
+		rules    Rules
+		address  string
+		resolved string
+		allow    bool
+	}{
+		{name: "no rules", address: "192.168.0.1:80", resolved: "192.168.0.1:80", allow: true},
+		{name: "nil allow list", rules: Rules{Allow: []AddressList{nil}}, address: "192.168.0.1:80", resolved: "192.168.0.1:80", allow: true},
+		{name: "every allow list matches", rules: Rules{Allow: []AddressList{server, policy}}, address: "10.1.9.9:80", resolved: "10.1.9.9:80", allow: true},
+		{name: "one allow list misses", rules: Rules{Allow: []AddressList{server, policy}}, address: "10.2.0.1:80", resolved: "10.2.0.1:80"},
+		{name: "denied", rules: Rules{Allow: []AddressList{server}, Deny: []AddressList{deny}}, address: "10.1.2.3:80", resolved: "10.1.2.3:80"},
+		{name: "hostname resolving into a denied range", rules: Rules{Allow: []AddressList{server}, Deny: []AddressList{deny}}, address: "example.com:443", resolved: "10.1.2.3:443"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			network, address := SplitNetwork(c.address)
+			if c.rules.Allows(network, address, c.resolved) != c.allow {
+				t.Fatalf("allowed %v want %v", !c.allow, c.allow)
+			}
+		})
+	}
+}
+
+func TestRulesAllowsFixed(t *testing.T) {
+	list, err := ParseAddressList([]string{"unix:/run/app/*.sock", "127.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := Rules{Allow: []AddressList{list}}
+	for _, c := range []struct {
+		address string
+		allow   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.0.0.1:8081", false},
+		{"unix:/run/app/web.sock", true},
+		{"unix:/tmp/web.sock", false},
+		// hostnames are only checked once they are resolved
+		{"example.com:8081", true},
+	} {
+		if rules.AllowsFixed(c.address) != c.allow {
+			t.Fatalf("%s allowed %v want %v", c.address, !c.allow, c.allow)
+		}
+	}
+	if !(Rules{}).AllowsFixed("127.0.0.1:8081") {
+		t.Fatal("empty rules refused an address")
+	}
+}
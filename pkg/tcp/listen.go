@@ -2,15 +2,33 @@ package tcp
 
 import (
 	"context"
-	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/blend/go-sdk/logger"
 )
 
-func Listen(ctx context.Context, port uint16) (net.Listener, error) {
-	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Starting TCP listen on port %d", port)
-	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Listen listens on the port of host, or of every interface if host is empty.
+// IPv6 hosts are supported and the unspecified addresses are dual stack where
+// the system allows it.
+func Listen(ctx context.Context, host string, port uint16) (net.Listener, error) {
+	addr := JoinHostPort(host, port)
+	logger.MaybeDebugfContext(ctx, logger.GetLogger(ctx), "Starting TCP listen on %s", addr)
+	return net.Listen("tcp", addr)
+}
+
+func JoinHostPort(host string, port uint16) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// PortFree reports whether the port can currently be listened on.
+func PortFree(host string, port uint16) bool {
+	listener, err := net.Listen("tcp", JoinHostPort(host, port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
 }
 
 func DialConnProvider(addr string) ConnProvider {
@@ -22,3 +40,24 @@ func DialConnProvider(addr string) ConnProvider {
 		return &WrappedConn{Conn: conn}, nil
 	}
 }
+
+// CloseOnStop closes the listener once the context is done or stop is closed
+// so a blocked Accept returns.
+func CloseOnStop(ctx context.Context, stop chan struct{}, listener net.Listener) {
+	select {
+	case <-ctx.Done():
+	case <-stop:
+	}
+	listener.Close()
+}
+
+func Stopped(ctx context.Context, stop chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
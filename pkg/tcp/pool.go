@@ -6,8 +6,11 @@ import (
 	"sync"
 )
 
+// Pool tracks a set of connections that are either free or in use. Waiters
+// can be handed a connection directly with Notify instead of through the free
+// set.
 type Pool struct {
-	// lock sync.Mutex
+	lock sync.Mutex
 
 	waitLock  sync.Mutex
 	waitQueue []chan Conn
@@ -28,35 +31,55 @@ func NewPool() *Pool {
 }
 
 func (p *Pool) SetConnectionProvider(connect ConnProvider) {
-	// p.lock.Lock()
-	// defer p.lock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.connect = connect
 }
 
 func (p *Pool) Size() int {
-	// p.lock.Lock()
-	// defer p.lock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return len(p.all)
 }
 
 func (p *Pool) Free() int {
-	// p.lock.Lock()
-	// defer p.lock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	return len(p.free)
 }
 
 func (p *Pool) Add(c Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.all[c] = struct{}{}
 	p.free[c] = struct{}{}
 }
 
 func (p *Pool) Remove(c Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	delete(p.all, c)
 	delete(p.free, c)
 	delete(p.inUse, c)
 }
 
+// Drain removes every connection from the pool and returns them.
+func (p *Pool) Drain() []Conn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conns := make([]Conn, 0, len(p.all))
+	for c := range p.all {
+		conns = append(conns, c)
+	}
+	p.all = make(map[Conn]struct{})
+	p.inUse = make(map[Conn]struct{})
+	p.free = make(map[Conn]struct{})
+	return conns
+}
+
 func (p *Pool) Aquire() (Conn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if len(p.free) == 0 {
 		return nil, fmt.Errorf("no available connections")
 	}
@@ -71,6 +94,8 @@ func (p *Pool) Aquire() (Conn, error) {
 }
 
 func (p *Pool) Release(c Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if _, has := p.inUse[c]; !has {
 		return
 	}
@@ -79,18 +104,15 @@ func (p *Pool) Release(c Conn) {
 }
 
 func (p *Pool) Notify(c Conn) bool {
-	notified := false
-	fmt.Println("waiting on lock to notify")
 	p.waitLock.Lock()
-	if len(p.waitQueue) > 0 {
-		p.waitQueue[0] <- c
-		close(p.waitQueue[0])
-		p.waitQueue = p.waitQueue[1:]
-		notified = true
+	defer p.waitLock.Unlock()
+	if len(p.waitQueue) == 0 {
+		return false
 	}
-	fmt.Println("done notifying")
-	p.waitLock.Unlock()
-	return notified
+	p.waitQueue[0] <- c
+	close(p.waitQueue[0])
+	p.waitQueue = p.waitQueue[1:]
+	return true
 }
 
 func (p *Pool) Wait(ctx context.Context) (Conn, error) {
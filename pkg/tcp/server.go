@@ -14,15 +14,19 @@ type Server struct {
 	lock    sync.Mutex
 	running bool
 	stop    chan struct{}
+	host    string
 	port    uint16
+	// bound is the listener opened by Bind for the next Listen
+	bound net.Listener
 
 	newConn ConnProvider
 
 	tunnels map[*Tunnel]struct{}
 }
 
-func NewServer(port uint16, provider ConnProvider) *Server {
+func NewServer(host string, port uint16, provider ConnProvider) *Server {
 	return &Server{
+		host:    host,
 		port:    port,
 		newConn: provider,
 		tunnels: make(map[*Tunnel]struct{}),
@@ -30,10 +34,30 @@ func NewServer(port uint16, provider ConnProvider) *Server {
 	}
 }
 
+func (s *Server) Host() string {
+	return s.host
+}
+
 func (s *Server) Port() uint16 {
 	return s.port
 }
 
+// Bind opens the listener ahead of Listen, so a port that cannot be bound is
+// reported before anyone is told it is being served.
+func (s *Server) Bind(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.bound != nil {
+		return nil
+	}
+	listener, err := Listen(ctx, s.host, s.port)
+	if err != nil {
+		return err
+	}
+	s.bound = listener
+	return nil
+}
+
 func (s *Server) Listen(ctx context.Context) error {
 	log := logger.GetLogger(ctx)
 	s.lock.Lock()
@@ -44,12 +68,22 @@ func (s *Server) Listen(ctx context.Context) error {
 	stop := make(chan struct{})
 	s.stop = stop
 	s.running = true
+	listener := s.bound
+	s.bound = nil
 	s.lock.Unlock()
 
-	listener, err := Listen(ctx, s.port)
+	var err error
+	if listener == nil {
+		listener, err = Listen(ctx, s.host, s.port)
+	}
 	if err != nil {
+		s.lock.Lock()
+		s.stop = nil
+		s.running = false
+		s.lock.Unlock()
 		return err
 	}
+	go CloseOnStop(ctx, stop, listener)
 
 	defer func() {
 		s.lock.Lock()
@@ -74,6 +108,9 @@ func (s *Server) Listen(ctx context.Context) error {
 			logger.MaybeErrorfContext(ctx, log, "Error listening for new tcp connections in server %s", err.Error())
 			continue
 		}
+		if conn == nil {
+			continue
+		}
 		// fmt.Println("Got new connection on", s.port, conn.RemoteAddr())
 		err = s.addConn(ctx, conn)
 		if err != nil {
@@ -86,6 +123,10 @@ func (s *Server) Listen(ctx context.Context) error {
 func (s *Server) Stop() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.bound != nil {
+		s.bound.Close()
+		s.bound = nil
+	}
 	if !s.running {
 		return
 	}
@@ -117,7 +158,10 @@ func (s *Server) addConn(ctx context.Context, conn net.Conn) error {
 	// s.lock.Lock()
 	// defer s.lock.Unlock()
 	// fmt.Println("Requesting connection to forward")
-	upstream, err := s.newConn(ctx)
+	upstream, err := s.newConn(WithConnMeta(ctx, ConnMeta{
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+	}))
 	if err != nil {
 		conn.Close()
 		return err
@@ -151,6 +195,9 @@ func (s *Server) listenForNew(ctx context.Context, stop chan struct{}, listener
 
 		conn, err := listener.Accept()
 		if err != nil {
+			if Stopped(ctx, stop) {
+				return nil, nil
+			}
 			logger.MaybeErrorfContext(ctx, logger.GetLogger(ctx), "Error on server accept %s", err.Error())
 			continue
 		}
@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"io"
+	"net"
 	"sync"
 )
 
@@ -40,16 +42,25 @@ func (t *Tunnel) Run(ctx context.Context) error {
 	t.lock.Unlock()
 
 	go func() {
-		errs <- t.readAndForward(ctx, t.stop, t.conn1, t.conn2)
+		errs <- t.readAndForward(ctx, stop, t.conn1, t.conn2)
 	}()
 	go func() {
-		errs <- t.readAndForward(ctx, t.stop, t.conn2, t.conn1)
+		errs <- t.readAndForward(ctx, stop, t.conn2, t.conn1)
 	}()
 
+	// a direction that reaches EOF half-closes the other side, the tunnel
+	// runs until both are done or either fails
 	var err error
-	select {
-	case err = <-errs:
-	case <-stop:
+wait:
+	for done := 0; done < 2; done++ {
+		select {
+		case err = <-errs:
+			if err != nil {
+				break wait
+			}
+		case <-stop:
+			break wait
+		}
 	}
 	t.conn1.Close(ctx)
 	t.conn2.Close(ctx)
@@ -99,7 +110,21 @@ func (t *Tunnel) Stop(ctx context.Context) error {
 }
 
 func (t *Tunnel) readAndForward(ctx context.Context, stop chan struct{}, read, write Conn) error {
-	buf := make([]byte, 4096)
+	src, srcOK := netConn(read).(*net.TCPConn)
+	dst, dstOK := netConn(write).(*net.TCPConn)
+	if srcOK && dstOK {
+		// the kernel copies between sockets itself, with splice on Linux
+		_, err := io.Copy(dst, src)
+		if err != nil {
+			return err
+		}
+		return write.CloseWrite(ctx)
+	}
+
+	pool := GetBufferPool(ctx)
+	pooled := pool.Get()
+	defer pool.Put(pooled)
+	buf := *pooled
 	for {
 		select {
 		case <-ctx.Done():
@@ -110,6 +135,9 @@ func (t *Tunnel) readAndForward(ctx context.Context, stop chan struct{}, read, w
 		}
 
 		n, err := read.Read(ctx, buf)
+		if err == io.EOF {
+			return write.CloseWrite(ctx)
+		}
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,167 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunnelHalfClose(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// first is the end that finishes writing first
+		first int
+	}{
+		{name: "client done first", first: 0},
+		{name: "server done first", first: 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			client, in := tcpPair(t)
+			out, server := tcpPair(t)
+			tunnel := NewTunnel(WrapConn(in), WrapConn(out))
+			done := make(chan error, 1)
+			go func() {
+				done <- tunnel.Run(ctx)
+			}()
+
+			ends := []net.Conn{client, server}
+			first, second := ends[c.first], ends[1-c.first]
+			if _, err := first.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if err := first.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, second); got != "ping" {
+				t.Fatalf("read %q", got)
+			}
+			// the other direction keeps flowing after the half-close
+			if _, err := second.Write([]byte("pong")); err != nil {
+				t.Fatal(err)
+			}
+			second.(*net.TCPConn).CloseWrite()
+			if got := readAll(t, first); got != "pong" {
+				t.Fatalf("read %q", got)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("tunnel still running")
+			}
+		})
+	}
+}
+
+func TestTunnelCopy(t *testing.T) {
+	passthrough := func(ctx context.Context, conn Conn, err error) error { return err }
+	for _, c := range []struct {
+		name       string
+		wrap       func(Conn) Conn
+		bufferSize int
+	}{
+		{name: "kernel copy", wrap: func(conn Conn) Conn { return conn }},
+		{name: "owned conn without error hook", wrap: func(conn Conn) Conn { return OwnConn(conn, nil, nil) }},
+		// the error hook must see every read, so the tunnel copies itself
+		// through a buffer smaller than the payload
+		{name: "buffered copy", wrap: func(conn Conn) Conn { return OwnConn(conn, passthrough, nil) }, bufferSize: 1000},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := WithBufferPool(context.Background(), NewBufferPool(c.bufferSize))
+			client, in := tcpPair(t)
+			out, server := tcpPair(t)
+			tunnel := NewTunnel(c.wrap(WrapConn(in)), c.wrap(WrapConn(out)))
+			done := make(chan error, 1)
+			go func() {
+				done <- tunnel.Run(ctx)
+			}()
+
+			payload := bytes.Repeat([]byte("0123456789"), 10000)
+			go func() {
+				client.Write(payload)
+				client.(*net.TCPConn).CloseWrite()
+				server.Write(payload)
+				server.(*net.TCPConn).CloseWrite()
+			}()
+			if got := readAll(t, server); got != string(payload) {
+				t.Fatalf("server read %d bytes", len(got))
+			}
+			if got := readAll(t, client); got != string(payload) {
+				t.Fatalf("client read %d bytes", len(got))
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("tunnel still running")
+			}
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		size int
+		want int
+	}{
+		{name: "default", size: 0, want: DefaultBufferSize},
+		{name: "negative", size: -1, want: DefaultBufferSize},
+		{name: "configured", size: 512, want: 512},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pool := NewBufferPool(c.size)
+			buf := pool.Get()
+			if pool.Size() != c.want || len(*buf) != c.want {
+				t.Fatalf("size %d buffer %d want %d", pool.Size(), len(*buf), c.want)
+			}
+			pool.Put(buf)
+			if GetBufferPool(WithBufferPool(context.Background(), pool)) != pool {
+				t.Fatal("context pool not used")
+			}
+		})
+	}
+	if GetBufferPool(context.Background()).Size() != DefaultBufferSize {
+		t.Fatal("no default pool")
+	}
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func readAll(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}